@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	StateOK       = "ok"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+var ErrCondition = errors.New("invalid alert condition")
+var ErrWebhook = errors.New("webhook not allowed")
+
+// WebhookPrefixes are URL prefixes of webhooks any client may add to rules.
+// Other webhooks need the admin token, so the server can't be made to post
+// to arbitrary addresses.
+var WebhookPrefixes []string
+
+// Rule is an alert rule of a namespace. Its condition is kept as an expression,
+// e.g. "signup.day slot 0 < 10 by 18:00" or "errors.realtime sum > 100".
+type Rule struct {
+	ID       string            `json:"id"`
+	NS       string            `json:"ns"`
+	Name     string            `json:"name"`
+	Expr     string            `json:"expr" binding:"required"`
+	Labels   map[string]string `json:"labels"`
+	Webhooks []string          `json:"webhooks" binding:"omitempty,dive,url"`
+	State    string            `json:"state"`
+	Since    time.Time         `json:"since"`
+	Value    Value             `json:"value"`
+}
+
+// Condition is a parsed alert expression:
+//
+//	<metric>.<bucket> <slot N|anomaly N|sum|avg|min|max> <op> <threshold> [by HH:MM]
+//
+// A condition with "by" is only checked after that time of day. "anomaly N"
+// is the score of the current slot against previous seasons of N slots, see
+// Detect, e.g. "signup.month anomaly 7 < -3" fires on an unusually quiet day.
+type Condition struct {
+	Metric    string
+	Bucket    int
+	Agg       string
+	Slot      int
+	Season    int
+	Op        string
+	Threshold Value
+	By        time.Duration
+}
+
+func ParseCondition(expr string) (*Condition, error) {
+	f := strings.Fields(expr)
+	cond := &Condition{}
+	if len(f) < 4 {
+		return nil, ErrCondition
+	}
+	dot := strings.LastIndex(f[0], ".")
+	if dot <= 0 {
+		return nil, ErrCondition
+	}
+	cond.Metric = f[0][:dot]
+	if cond.Bucket = BucketIndex(f[0][dot+1:]); cond.Bucket < 0 {
+		return nil, ErrCondition
+	}
+	cond.Agg, f = f[1], f[2:]
+	switch cond.Agg {
+	case "slot":
+		slot, err := strconv.Atoi(f[0])
+		if err != nil || slot < 0 || slot >= Buckets[cond.Bucket].Size {
+			return nil, ErrCondition
+		}
+		cond.Slot, f = slot, f[1:]
+	case "anomaly":
+		season, err := strconv.Atoi(f[0])
+		if err != nil || season < 1 {
+			return nil, ErrCondition
+		}
+		cond.Season, f = season, f[1:]
+	case "sum", "avg", "min", "max":
+	default:
+		return nil, ErrCondition
+	}
+	if len(f) != 2 && len(f) != 4 {
+		return nil, ErrCondition
+	}
+	switch f[0] {
+	case "<", "<=", ">", ">=", "==", "!=":
+		cond.Op = f[0]
+	default:
+		return nil, ErrCondition
+	}
+	if v, err := strconv.ParseFloat(f[1], 64); err != nil {
+		return nil, ErrCondition
+	} else {
+		cond.Threshold = Value(v)
+	}
+	if len(f) == 4 {
+		if f[2] != "by" {
+			return nil, ErrCondition
+		}
+		by, err := time.Parse("15:04", f[3])
+		if err != nil {
+			return nil, ErrCondition
+		}
+		cond.By = time.Duration(by.Hour())*time.Hour + time.Duration(by.Minute())*time.Minute
+	}
+	return cond, nil
+}
+
+// Value aggregates the values of the condition bucket. Anomaly scores fail
+// with ErrHistory until the counter has enough previous seasons.
+func (cond *Condition) Value(c *Counter) (Value, error) {
+	values := c.Values[cond.Bucket]
+	if cond.Agg == "slot" {
+		return values[cond.Slot], nil
+	} else if cond.Agg == "anomaly" {
+		a, err := Detect(c, cond.Bucket, cond.Season, 0, 0)
+		if err != nil {
+			return 0, err
+		}
+		return Value(a.Score), nil
+	}
+	v := values[0]
+	for _, x := range values[1:] {
+		switch cond.Agg {
+		case "sum", "avg":
+			v += x
+		case "min":
+			if x < v {
+				v = x
+			}
+		case "max":
+			if x > v {
+				v = x
+			}
+		}
+	}
+	if cond.Agg == "avg" {
+		v = v / Value(len(values))
+	}
+	return v, nil
+}
+
+// Eval returns the aggregated value and whether the condition holds at time t.
+// If the value can't be computed the state of the condition is unknown and
+// the error is returned.
+func (cond *Condition) Eval(c *Counter, t time.Time) (Value, bool, error) {
+	v, err := cond.Value(c)
+	if err != nil {
+		return 0, false, err
+	}
+	if cond.By > 0 {
+		// Time of day in the time zone of the namespace
+		lt := t.In(c.Location())
+		if time.Duration(lt.Hour())*time.Hour+time.Duration(lt.Minute())*time.Minute < cond.By {
+			return v, false, nil
+		}
+	}
+	switch cond.Op {
+	case "<":
+		return v, v < cond.Threshold, nil
+	case "<=":
+		return v, v <= cond.Threshold, nil
+	case ">":
+		return v, v > cond.Threshold, nil
+	case ">=":
+		return v, v >= cond.Threshold, nil
+	case "==":
+		return v, v == cond.Threshold, nil
+	default:
+		return v, v != cond.Threshold, nil
+	}
+}
+
+// Notification is sent to the webhooks of a rule when its state changes.
+type Notification struct {
+	ID       string    `json:"id"`
+	NS       string    `json:"ns"`
+	Expr     string    `json:"expr"`
+	State    string    `json:"state"`
+	Value    Value     `json:"value"`
+	Time     time.Time `json:"time"`
+	Webhooks []string  `json:"-"`
+}
+
+// Alerter periodically evaluates alert rules and notifies about state changes.
+type Alerter struct {
+	Store        Store
+	Client       *http.Client
+	Retries      int
+	Backoff      time.Duration
+	Alertmanager *Alertmanager
+}
+
+func NewAlerter(s Store) *Alerter {
+	return &Alerter{
+		Store:   s,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		Retries: 3,
+		Backoff: time.Second,
+	}
+}
+
+// Check evaluates every rule once, saves the new states and returns the
+// notifications for rules that started firing or got resolved.
+func (a *Alerter) Check() ([]*Notification, error) {
+	rules, err := a.Store.Rules("")
+	if err != nil {
+		return nil, err
+	}
+	now := Now()
+	notifications := []*Notification{}
+	for _, r := range rules {
+		cond, err := ParseCondition(r.Expr)
+		if err != nil {
+			log.Println(r.NS, r.ID, err)
+			continue
+		}
+		c, err := a.Store.Query(r.NS, cond.Metric)
+		if err == ErrNotFound {
+			n, err := a.Store.Namespace(r.NS)
+			if err != nil {
+				log.Println(r.NS, r.ID, err)
+				continue
+			}
+			c = NewCounterIn(nil, n.Location())
+		} else if err != nil {
+			log.Println(r.NS, r.ID, err)
+			continue
+		}
+		v, firing, err := cond.Eval(c, now)
+		if err == ErrHistory {
+			// Unknown yet, the rule keeps its state
+			continue
+		} else if err != nil {
+			log.Println(r.NS, r.ID, err)
+			continue
+		}
+		state := StateOK
+		if firing {
+			state = StateFiring
+		}
+		if state == r.State || (state == StateOK && r.State == "") {
+			continue
+		}
+		r.State, r.Since, r.Value = state, now, v
+		if err := a.Store.PutRuleState(r); err == ErrNotFound {
+			// The rule was deleted meanwhile
+			continue
+		} else if err != nil {
+			return notifications, err
+		}
+		n := &Notification{ID: r.ID, NS: r.NS, Expr: r.Expr, State: state, Value: v, Time: now, Webhooks: r.Webhooks}
+		if state == StateOK {
+			n.State = StateResolved
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+// Notify posts the notification to every webhook of the rule, retrying
+// failed deliveries with exponential backoff.
+func (a *Alerter) Notify(n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, url := range n.Webhooks {
+		backoff := a.Backoff
+		for attempt := 0; attempt < a.Retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(backoff)
+				backoff = backoff * 2
+			}
+			if err = a.post(url, body); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", url, err)
+		}
+	}
+	return lastErr
+}
+
+func (a *Alerter) post(url string, body []byte) error {
+	resp, err := a.Client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Run checks the rules every interval and delivers notifications in the
+// background, so a slow webhook does not delay the next check.
+func (a *Alerter) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		notifications, err := a.Check()
+		if err != nil {
+			log.Println("alerts:", err)
+		}
+		for _, n := range notifications {
+			go func(n *Notification) {
+				if err := a.Notify(n); err != nil {
+					log.Println("alerts:", n.NS, n.ID, err)
+				}
+			}(n)
+		}
+		if a.Alertmanager != nil {
+			if rules, err := a.Store.Rules(""); err != nil {
+				log.Println("alerts:", err)
+			} else if err := a.Alertmanager.Push(rules); err != nil {
+				log.Println("alerts:", err)
+			}
+		}
+	}
+}
+
+func listRules(c *gin.Context, s Store) {
+	if rules, err := s.Rules(c.Param("ns")); err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.JSON(200, rules)
+	}
+}
+
+func createRule(c *gin.Context, s Store) {
+	r := &Rule{}
+	if c.BindWith(r, binding.JSON) != nil {
+		return
+	}
+	if _, err := ParseCondition(r.Expr); err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	for _, url := range r.Webhooks {
+		if !webhookAllowed(url) && !isAdmin(c) {
+			c.AbortWithError(403, ErrWebhook)
+			return
+		}
+	}
+	r.ID, r.NS, r.State, r.Since = "", c.Param("ns"), StateOK, Now()
+	if err := s.PutRule(r); err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.JSON(201, r)
+	}
+}
+
+func webhookAllowed(url string) bool {
+	for _, prefix := range WebhookPrefixes {
+		if strings.HasPrefix(url, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func deleteRule(c *gin.Context, s Store) {
+	if err := s.DeleteRule(c.Param("ns"), c.Param("id")); err == ErrNotFound {
+		c.AbortWithStatus(404)
+	} else if err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.AbortWithStatus(200)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseCondition(t *testing.T) {
+	if c, err := ParseCondition("signup.day slot 0 < 10 by 18:00"); err != nil {
+		t.Error(err)
+	} else if c.Metric != "signup" || c.Bucket != BucketIndex("day") || c.Agg != "slot" ||
+		c.Slot != 0 || c.Op != "<" || c.Threshold != 10 || c.By != 18*time.Hour {
+		t.Error(c)
+	}
+	if c, err := ParseCondition("errors{code=500}.realtime sum > 100"); err != nil {
+		t.Error(err)
+	} else if c.Metric != "errors{code=500}" || c.Agg != "sum" || c.Op != ">" || c.By != 0 {
+		t.Error(c)
+	}
+	for _, expr := range []string{
+		"", "signup slot 0 < 10", "signup.week sum > 1", "signup.day slot 24 < 10",
+		"signup.day median > 1", "signup.day sum ~ 1", "signup.day sum > x",
+		"signup.day sum > 1 until 18:00", "signup.day sum > 1 by 25:00",
+	} {
+		if _, err := ParseCondition(expr); err == nil {
+			t.Error(expr)
+		}
+	}
+}
+
+func TestConditionEval(t *testing.T) {
+	c := NewCounter(nil)
+	c.Values[BucketIndex("day")][0] = 5
+	c.Values[BucketIndex("day")][1] = 3
+	cond, _ := ParseCondition("signup.day slot 0 < 10 by 18:00")
+	if _, firing, _ := cond.Eval(c, time.Unix(17*3600, 0)); firing {
+		t.Error("fired before 18:00")
+	}
+	if v, firing, _ := cond.Eval(c, time.Unix(18*3600, 0)); !firing || v != 5 {
+		t.Error(v, firing)
+	}
+	for expr, want := range map[string]Value{
+		"signup.day sum > 0": 8, "signup.day max > 0": 5, "signup.day min > 0": 0,
+		"signup.day avg > 0": Value(8) / 24,
+	} {
+		cond, _ := ParseCondition(expr)
+		if v, _ := cond.Value(c); v != want {
+			t.Error(expr, v)
+		}
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+
+	received := []*Notification{}
+	failures := 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(503)
+			return
+		}
+		n := &Notification{}
+		json.NewDecoder(r.Body).Decode(n)
+		received = append(received, n)
+	}))
+	defer ts.Close()
+
+	seconds = 0
+	s.PutRule(&Rule{NS: "foo", Expr: "errors.realtime sum > 2", Webhooks: []string{ts.URL}})
+	a := NewAlerter(s)
+	a.Backoff = time.Millisecond
+
+	if n, err := a.Check(); err != nil || len(n) != 0 {
+		t.Error(n, err)
+	}
+
+	s.Apply("foo", []Event{{Metric: "errors", Value: 3}})
+	n, err := a.Check()
+	if err != nil || len(n) != 1 || n[0].State != StateFiring || n[0].Value != 3 {
+		t.Fatal(n, err)
+	}
+	if err := a.Notify(n[0]); err != nil {
+		t.Error(err)
+	} else if len(received) != 1 || received[0].State != StateFiring || received[0].NS != "foo" {
+		t.Error(received)
+	}
+	if rules, _ := s.Rules("foo"); len(rules) != 1 || rules[0].State != StateFiring {
+		t.Error(rules)
+	}
+
+	// Still firing, nothing to notify
+	if n, _ := a.Check(); len(n) != 0 {
+		t.Error(n)
+	}
+
+	seconds = 100
+	if n, _ := a.Check(); len(n) != 1 || n[0].State != StateResolved {
+		t.Error(n)
+	}
+
+	// Anomaly rules don't fire without history
+	s.PutRule(&Rule{NS: "foo", Expr: "errors.day anomaly 24 < 1", Webhooks: []string{ts.URL}})
+	if n, err := a.Check(); err != nil || len(n) != 0 {
+		t.Error(n, err)
+	}
+
+	if err := s.DeleteRule("foo", "1"); err != nil {
+		t.Error(err)
+	} else if err := s.DeleteRule("foo", "1"); err != ErrNotFound {
+		t.Error(err)
+	}
+}
+
+func TestRuleWebhooks(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	defer os.Setenv("INCRADMINTOKEN", os.Getenv("INCRADMINTOKEN"))
+	defer func(prefixes []string) { WebhookPrefixes = prefixes }(WebhookPrefixes)
+	s, _ := NewStore(dbPath)
+
+	e := gin.New()
+	e.POST("/alerts/:ns", func(c *gin.Context) { createRule(c, s) })
+	post := func(webhook, auth string) int {
+		w := httptest.NewRecorder()
+		body := `{"expr": "signup.day slot 0 < 10", "webhooks": ["` + webhook + `"]}`
+		req := httptest.NewRequest("POST", "/alerts/foo", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		e.ServeHTTP(w, req)
+		return w.Code
+	}
+	os.Setenv("INCRADMINTOKEN", "secret")
+	WebhookPrefixes = []string{"https://hooks.example.com/"}
+	if code := post("https://hooks.example.com/incr", ""); code != 201 {
+		t.Error(code)
+	}
+	if code := post("http://169.254.169.254/latest", ""); code != 403 {
+		t.Error(code)
+	}
+	if code := post("http://169.254.169.254/latest", "Bearer wrong"); code != 403 {
+		t.Error(code)
+	}
+	if code := post("http://localhost:9000/hook", "Bearer secret"); code != 201 {
+		t.Error(code)
+	}
+	if rules, _ := s.Rules("foo"); len(rules) != 2 {
+		t.Error(rules)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alertmanager pushes the state of alert rules to a Prometheus Alertmanager
+// using its v2 API. Firing alerts are resent every Resend interval, so that
+// Alertmanager does not expire them, and resolved ones are sent once with
+// endsAt set to the time they got resolved. Alerts of rules deleted while
+// firing are resolved on the next push.
+type Alertmanager struct {
+	URL    string
+	Resend time.Duration
+	Client *http.Client
+
+	mu      sync.Mutex
+	sent    map[string]*sentAlert
+	started bool
+}
+
+// sentAlert is the last alert pushed for a firing rule.
+type sentAlert struct {
+	amAlert
+	At time.Time
+}
+
+type amAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+func NewAlertmanager(url string, resend time.Duration) *Alertmanager {
+	return &Alertmanager{
+		URL:    strings.TrimSuffix(url, "/"),
+		Resend: resend,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		sent:   map[string]*sentAlert{},
+	}
+}
+
+func (am *Alertmanager) alert(r *Rule) amAlert {
+	labels := map[string]string{}
+	for k, v := range r.Labels {
+		labels[k] = v
+	}
+	labels["alertname"] = r.Name
+	if r.Name == "" {
+		if cond, err := ParseCondition(r.Expr); err == nil {
+			labels["alertname"] = cond.Metric
+		}
+	}
+	labels["ns"] = r.NS
+	labels["rule"] = r.ID
+	return amAlert{
+		Labels: labels,
+		Annotations: map[string]string{
+			"summary": r.Expr,
+			"value":   fmt.Sprint(r.Value),
+		},
+		StartsAt: r.Since,
+	}
+}
+
+// Push sends firing rules that were not sent within the resend interval and
+// rules resolved since they were last sent. Rules that fail to be delivered
+// are sent again on the next push. Sent alerts are only kept in memory, so
+// the first push also resolves rules that got resolved within the lifetime
+// of alerts sent before a restart; older alerts have expired in
+// Alertmanager already.
+func (am *Alertmanager) Push(rules []*Rule) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	now := Now()
+	alerts := []amAlert{}
+	sent := map[string]*sentAlert{}
+	seen := map[string]bool{}
+	for _, r := range rules {
+		key := r.NS + ":" + r.ID
+		seen[key] = true
+		last, ok := am.sent[key]
+		if r.State == StateFiring && (!ok || now.Sub(last.At) >= am.Resend) {
+			a := am.alert(r)
+			a.EndsAt = now.Add(3 * am.Resend)
+			alerts = append(alerts, a)
+			sent[key] = &sentAlert{a, now}
+		} else if r.State != StateFiring && (ok || (!am.started && now.Sub(r.Since) < 3*am.Resend)) {
+			a := am.alert(r)
+			a.EndsAt = r.Since
+			alerts = append(alerts, a)
+			sent[key] = nil
+		}
+	}
+	for key, last := range am.sent {
+		if !seen[key] {
+			// The rule was deleted, its alert is resolved now
+			a := last.amAlert
+			a.EndsAt = now
+			alerts = append(alerts, a)
+			sent[key] = nil
+		}
+	}
+	if len(alerts) == 0 {
+		am.started = true
+		return nil
+	}
+
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	resp, err := am.Client.Post(am.URL+"/api/v2/alerts", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alertmanager: status %d", resp.StatusCode)
+	}
+	for key, a := range sent {
+		if a == nil {
+			delete(am.sent, key)
+		} else {
+			am.sent[key] = a
+		}
+	}
+	am.started = true
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAlertmanager(t *testing.T) {
+	pushes := [][]amAlert{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/alerts" {
+			w.WriteHeader(404)
+			return
+		}
+		alerts := []amAlert{}
+		json.NewDecoder(r.Body).Decode(&alerts)
+		pushes = append(pushes, alerts)
+	}))
+	defer ts.Close()
+
+	am := NewAlertmanager(ts.URL+"/", time.Minute)
+	rule := &Rule{ID: "1", NS: "foo", Expr: "errors.realtime sum > 2",
+		Labels: map[string]string{"severity": "page"}, State: StateOK}
+
+	seconds = 0
+	if err := am.Push([]*Rule{rule}); err != nil || len(pushes) != 0 {
+		t.Error(pushes, err)
+	}
+
+	rule.State, rule.Since, rule.Value = StateFiring, Now(), 3
+	am.Push([]*Rule{rule})
+	if len(pushes) != 1 || len(pushes[0]) != 1 {
+		t.Fatal(pushes)
+	}
+	a := pushes[0][0]
+	if a.Labels["alertname"] != "errors" || a.Labels["severity"] != "page" || a.Labels["ns"] != "foo" {
+		t.Error(a.Labels)
+	} else if a.Annotations["value"] != "3" || !a.StartsAt.Equal(Now()) || !a.EndsAt.After(Now()) {
+		t.Error(a)
+	}
+
+	// Not resent before the resend interval
+	seconds = 30
+	am.Push([]*Rule{rule})
+	seconds = 60
+	am.Push([]*Rule{rule})
+	if len(pushes) != 2 {
+		t.Error(pushes)
+	}
+
+	seconds = 90
+	rule.State, rule.Since = StateOK, Now()
+	am.Push([]*Rule{rule})
+	am.Push([]*Rule{rule})
+	if len(pushes) != 3 {
+		t.Fatal(pushes)
+	} else if !pushes[2][0].EndsAt.Equal(Now()) {
+		t.Error(pushes[2][0])
+	}
+}
+
+func TestAlertmanagerResolve(t *testing.T) {
+	pushes := [][]amAlert{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alerts := []amAlert{}
+		json.NewDecoder(r.Body).Decode(&alerts)
+		pushes = append(pushes, alerts)
+	}))
+	defer ts.Close()
+
+	am := NewAlertmanager(ts.URL, time.Minute)
+	seconds = 0
+	rule := &Rule{ID: "1", NS: "foo", Name: "errors", Expr: "errors.realtime sum > 2", State: StateFiring, Since: Now()}
+	am.Push([]*Rule{rule})
+
+	// Deleted rules are resolved once
+	seconds = 30
+	am.Push(nil)
+	am.Push(nil)
+	if len(pushes) != 2 || len(pushes[1]) != 1 {
+		t.Fatal(pushes)
+	} else if a := pushes[1][0]; a.Labels["rule"] != "1" || a.Labels["alertname"] != "errors" || !a.EndsAt.Equal(Now()) {
+		t.Error(a)
+	}
+
+	// After a restart rules resolved while their alerts may still be active
+	// are resolved again
+	am = NewAlertmanager(ts.URL, time.Minute)
+	seconds = 200
+	recent := &Rule{ID: "2", NS: "foo", Expr: "a.realtime sum > 1", State: StateOK, Since: Now()}
+	old := &Rule{ID: "3", NS: "foo", Expr: "b.realtime sum > 1", State: StateOK, Since: time.Unix(0, 0)}
+	seconds = 260
+	am.Push([]*Rule{recent, old})
+	am.Push([]*Rule{recent, old})
+	if len(pushes) != 3 || len(pushes[2]) != 1 || pushes[2][0].Labels["rule"] != "2" {
+		t.Error(pushes)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+// Align tells how slots of counters without a time zone line up with the
+// clock.
+type Align uint8
+
+const (
+	// AlignRound is the original behaviour: slots are centred on multiples of
+	// the bucket period, so an hourly slot covers 10:30-11:30 and is labelled
+	// 11:00. Counters written before alignment was recorded use it.
+	AlignRound Align = iota
+	// AlignTruncate makes slots start at multiples of the bucket period, so an
+	// hourly slot covers 11:00-12:00 and is labelled 11:00.
+	AlignTruncate
+)
+
+// Alignment is used for new counters, existing counters are migrated to it
+// when the store is opened. It can be set to AlignRound with INCRALIGN=round
+// to keep the legacy behaviour.
+var Alignment = AlignTruncate
+
+// Relabel switches the counter to another alignment. Slots keep their values
+// and move to the period that overlaps most with what they used to cover:
+// with rounding slot 0 of a counter last touched at 10:40 holds 10:30-10:40,
+// which lies within 10:00-11:00, slot 0 with truncation. Older slots can't be
+// split, so the values of their first half shift by half a period: slot 1,
+// 09:30-10:30, is added to slot 0 as well. Touched at 10:20 slot 0 holds
+// 09:30-10:20 and every slot keeps its index. Counters with a time zone
+// follow the calendar and only change the label.
+func (c *Counter) Relabel(a Align) {
+	if c.Align == a {
+		return
+	}
+	c.initCounts()
+	if c.loc == nil {
+		for i, bucket := range Buckets {
+			if bucket.Size == 1 {
+				continue
+			}
+			// A rounded slot moves to the truncated period starting at its label
+			d := int(c.Atime.Truncate(bucket.Period).Sub(c.Atime.Round(bucket.Period)) / bucket.Period)
+			if a == AlignRound {
+				d = -d
+			}
+			c.shift(i, d)
+		}
+	}
+	c.Align = a
+}
+
+// shift moves the slots of bucket i, and the hourly history along with the
+// day bucket, one period back if d is positive. If d is negative they move
+// one period forward and slot 1 is added to slot 0.
+func (c *Counter) shift(i, d int) {
+	if d == 0 {
+		return
+	}
+	hours := i == BucketIndex("day") && c.Hours != nil
+	if d > 0 {
+		c.Values[i] = append([]Value{0}, c.Values[i]...)[:len(c.Values[i])]
+		if c.Counts != nil {
+			c.Counts[i] = append([]int64{0}, c.Counts[i]...)[:len(c.Counts[i])]
+		}
+		if c.Hists != nil {
+			c.Hists[i] = append([]Histogram{{}}, c.Hists[i]...)[:len(c.Hists[i])]
+		}
+		if c.TopK != nil {
+			c.TopK[i] = append([]TopK{{}}, c.TopK[i]...)[:len(c.TopK[i])]
+		}
+		if hours {
+			c.Hours = append([]Value{0}, c.Hours...)[:len(c.Hours)]
+		}
+		return
+	}
+	if c.counting() {
+		c.Counts[i][0] += c.Counts[i][1]
+		c.Values[i][0] = Value(c.Counts[i][0])
+		c.Counts[i] = append(append(c.Counts[i][:1:1], c.Counts[i][2:]...), 0)
+	} else if c.Values[i][0] == 0 {
+		c.Values[i][0] = c.Values[i][1]
+	}
+	c.Values[i] = append(append(c.Values[i][:1:1], c.Values[i][2:]...), 0)
+	if c.Hists != nil {
+		c.Hists[i][0].Merge(c.Hists[i][1])
+		c.Hists[i] = append(append(c.Hists[i][:1:1], c.Hists[i][2:]...), Histogram{})
+	}
+	if c.TopK != nil {
+		c.TopK[i][0].Merge(c.TopK[i][1])
+		c.TopK[i] = append(append(c.TopK[i][:1:1], c.TopK[i][2:]...), TopK{})
+	}
+	if hours {
+		if c.counting() {
+			c.Hours[0] += c.Hours[1]
+		} else if c.Hours[0] == 0 {
+			c.Hours[0] = c.Hours[1]
+		}
+		c.Hours = append(append(c.Hours[:1:1], c.Hours[2:]...), 0)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestAlignTruncate(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+	day := BucketIndex("day")
+
+	// 00:29 and 00:31 are the same hour, 01:00 starts the next one
+	seconds = 29 * 60
+	s.Incr("foo", "bar")
+	seconds = 31 * 60
+	s.Incr("foo", "bar")
+	seconds = 60 * 60
+	s.Incr("foo", "bar")
+	c, _ := s.Query("foo", "bar")
+	if v := c.Values[day]; v[0] != 1 || v[1] != 2 {
+		t.Error(v)
+	}
+	if start := c.SlotTime(day, 1); start.Unix() != 0 {
+		t.Error(start)
+	}
+}
+
+func TestAlignRound(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	defer func() { Alignment = AlignTruncate }()
+	Alignment = AlignRound
+	s, _ := NewStore(dbPath)
+	day := BucketIndex("day")
+
+	// With legacy rounding the hour flips at :30
+	seconds = 29 * 60
+	s.Incr("foo", "bar")
+	seconds = 31 * 60
+	s.Incr("foo", "bar")
+	seconds = 60 * 60
+	s.Incr("foo", "bar")
+	c, _ := s.Query("foo", "bar")
+	if v := c.Values[day]; v[0] != 2 || v[1] != 1 {
+		t.Error(v)
+	}
+	if start := c.SlotTime(day, 0); start.Unix() != 3600 {
+		t.Error(start)
+	}
+}
+
+func TestAlignMigrate(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	day := BucketIndex("day")
+	seconds = 40 * 60
+	legacy := NewCounter(nil)
+	legacy.Align = AlignRound
+	legacy.Incr()
+
+	db, _ := bolt.Open(dbPath, 0600, nil)
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists(IncrBucket)
+		return b.Put([]byte("foo:bar"), legacy.Bytes())
+	})
+	db.Close()
+
+	s, err := NewStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := s.Query("foo", "bar")
+	if c.Align != AlignTruncate {
+		t.Error(c.Align)
+	}
+	// The slot that was labelled 01:00 now is 00:00, values are kept
+	if v := c.Values[day]; v[0] != 1 {
+		t.Error(v)
+	}
+	if start := c.SlotTime(day, 0); start.Unix() != 0 {
+		t.Error(start)
+	}
+}
+
+func TestAlignRelabel(t *testing.T) {
+	day, hour := BucketIndex("day"), func(h, m int) time.Time {
+		return time.Unix(int64(h*3600+m*60), 0)
+	}
+
+	// Touched at 03:20 the rounded hours 02:30-03:30 and 01:30-02:30 become
+	// 03:00-04:00 and 02:00-03:00
+	seconds = 3*3600 + 20*60
+	c := NewCounter(nil)
+	c.Align = AlignRound
+	c.Add(hour(3, 10), 1)
+	c.Add(hour(2, 50), 1)
+	c.Add(hour(2, 10), 1)
+	c.Relabel(AlignTruncate)
+	if v := c.Values[day]; v[0] != 2 || v[1] != 1 || v[2] != 0 || c.Counts[day][0] != 2 {
+		t.Error(v[:3])
+	}
+	if start := c.SlotTime(day, 0); !start.Equal(hour(3, 0)) {
+		t.Error(start)
+	}
+
+	// Touched at 03:40 03:30-03:40 and 02:30-03:30 both lie in 03:00-04:00
+	seconds = 3*3600 + 40*60
+	c = NewCounter(nil)
+	c.Kind = KindTimer
+	c.Align = AlignRound
+	c.Add(hour(3, 35), 5)
+	c.Add(hour(3, 10), 7)
+	c.Add(hour(2, 10), 9)
+	c.Relabel(AlignTruncate)
+	if v := c.Values[day]; v[0] != 2 || v[1] != 1 || v[2] != 0 || c.Hours[0] != 2 || c.Hours[1] != 1 {
+		t.Error(v[:3], c.Hours[:3])
+	}
+	if h := c.Hists[day][0]; h.Count() != 2 {
+		t.Error(h)
+	}
+	if start := c.SlotTime(day, 1); !start.Equal(hour(2, 0)) {
+		t.Error(start)
+	}
+	// The total is kept either way
+	if v := c.Values[BucketIndex("total")][0]; v != 3 {
+		t.Error(v)
+	}
+}
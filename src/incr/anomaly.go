@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrHistory = errors.New("not enough history")
+
+// Anomaly compares a slot of a bucket against the same slot of previous
+// seasons, e.g. today against the same weekday of the previous weeks is slot
+// 0 of the "month" bucket with season 7.
+type Anomaly struct {
+	Metric    string  `json:"metric,omitempty"`
+	Bucket    string  `json:"bucket"`
+	Season    int     `json:"season"`
+	Slot      int     `json:"slot"`
+	Value     Value   `json:"value"`
+	Mean      float64 `json:"mean"`
+	Stddev    float64 `json:"stddev"`
+	Score     float64 `json:"score"`
+	Anomalous bool    `json:"anomalous"`
+}
+
+// Seasons are the named comparison modes: today against the same weekday of
+// previous weeks, this hour against the same hour of previous days and
+// this hour against the previous hours.
+var Seasons = map[string]struct {
+	Bucket string
+	Season int
+}{
+	"dow":    {"month", 7},
+	"hod":    {"day", 24},
+	"recent": {"day", 1},
+}
+
+// Detect scores the slot against slot+season, slot+2*season, ... of the
+// bucket in standard deviations. Score is positive for spikes and negative
+// for drops; the value is anomalous if the score is beyond sigma either way.
+// The day bucket is compared over the hourly history of the last week. Slots
+// from before the counter existed are not history.
+func Detect(c *Counter, bucket, season, slot int, sigma float64) (*Anomaly, error) {
+	values := c.Values[bucket]
+	if season < 1 || slot < 0 || slot >= len(values) {
+		return nil, ErrCondition
+	}
+	if bucket == BucketIndex("day") && c.Hours != nil {
+		values = c.Hours
+	}
+	history := []float64{}
+	for i := slot + season; i < c.observed(bucket, values); i += season {
+		history = append(history, float64(values[i]))
+	}
+	if len(history) < 2 {
+		return nil, ErrHistory
+	}
+	a := &Anomaly{Bucket: Buckets[bucket].Name, Season: season, Slot: slot, Value: values[slot]}
+	for _, v := range history {
+		a.Mean += v
+	}
+	a.Mean = a.Mean / float64(len(history))
+	for _, v := range history {
+		a.Stddev += (v - a.Mean) * (v - a.Mean)
+	}
+	a.Stddev = math.Sqrt(a.Stddev / float64(len(history)))
+	// Flat history would make any change infinitely anomalous, counts are
+	// whole numbers so one is the smallest meaningful deviation.
+	a.Score = (float64(a.Value) - a.Mean) / math.Max(a.Stddev, 1)
+	a.Anomalous = math.Abs(a.Score) > sigma
+	return a, nil
+}
+
+// observed returns the number of slots of the bucket values that lie
+// entirely after the counter was created. For counters stored before the
+// creation time was kept, leading empty slots are taken as not observed.
+func (c *Counter) observed(bucket int, values []Value) int {
+	n := len(values)
+	if c.Created.IsZero() {
+		for n > 0 && values[n-1] == 0 {
+			n--
+		}
+		return n
+	}
+	for n > 0 && c.SlotTime(bucket, n-1).Before(c.Created) {
+		n--
+	}
+	return n
+}
+
+// anomalyParams reads mode or bucket/season, slot and sigma from the query.
+func anomalyParams(c *gin.Context) (bucket, season, slot int, sigma float64, err error) {
+	mode, ok := Seasons[c.DefaultQuery("mode", "dow")]
+	if !ok {
+		return 0, 0, 0, 0, ErrCondition
+	}
+	if bucket = BucketIndex(c.DefaultQuery("bucket", mode.Bucket)); bucket < 0 {
+		return 0, 0, 0, 0, ErrCondition
+	}
+	if season, err = strconv.Atoi(c.DefaultQuery("season", strconv.Itoa(mode.Season))); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if slot, err = strconv.Atoi(c.DefaultQuery("slot", "0")); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if sigma, err = strconv.ParseFloat(c.DefaultQuery("sigma", "3"), 64); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return bucket, season, slot, sigma, nil
+}
+
+func anomaly(c *gin.Context, s Store) {
+	bucket, season, slot, sigma, err := anomalyParams(c)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	counter, err := s.Query(c.Param("ns"), c.Param("counter"))
+	if err == ErrNotFound {
+		c.AbortWithStatus(404)
+		return
+	} else if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if a, err := Detect(counter, bucket, season, slot, sigma); err == ErrHistory {
+		c.AbortWithError(422, err)
+	} else if err != nil {
+		c.AbortWithError(400, err)
+	} else {
+		a.Metric = c.Param("counter")
+		c.JSON(200, a)
+	}
+}
+
+// anomalies lists anomalous metrics of the namespace.
+func anomalies(c *gin.Context, s Store) {
+	bucket, season, slot, sigma, err := anomalyParams(c)
+	if err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+	list := []*Anomaly{}
+	if err := s.Walk(c.Param("ns"), func(name string, counter *Counter) error {
+		a, err := Detect(counter, bucket, season, slot, sigma)
+		if err == ErrHistory {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if a.Anomalous {
+			a.Metric = name
+			list = append(list, a)
+		}
+		return nil
+	}); err == ErrCondition {
+		c.AbortWithError(400, err)
+	} else if err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.JSON(200, list)
+	}
+}
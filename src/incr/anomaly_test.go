@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetect(t *testing.T) {
+	seconds = 100*24*60*60 + 30*60
+	c := NewCounter(nil)
+	c.Created = c.SlotTime(BucketIndex("month"), 29)
+	month := c.Values[BucketIndex("month")]
+	for i := range month {
+		month[i] = 100
+	}
+	month[7], month[14], month[21], month[28] = 10, 12, 8, 10
+	month[0] = 11
+
+	// Same weekday is quiet every week, today is normal
+	if a, err := Detect(c, BucketIndex("month"), 7, 0, 3); err != nil {
+		t.Fatal(err)
+	} else if a.Mean != 10 || a.Anomalous {
+		t.Error(a)
+	}
+	// Against the previous days today is unusually quiet
+	if a, _ := Detect(c, BucketIndex("month"), 1, 0, 2); !a.Anomalous || a.Score >= 0 {
+		t.Error(a)
+	}
+	month[0] = 40
+	if a, _ := Detect(c, BucketIndex("month"), 7, 0, 3); !a.Anomalous || a.Score <= 0 {
+		t.Error(a)
+	}
+	if _, err := Detect(c, BucketIndex("day"), 24*7, 0, 3); err != ErrHistory {
+		t.Error(err)
+	}
+
+	cond, err := ParseCondition("signup.month anomaly 7 > 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, firing, _ := cond.Eval(c, Now()); !firing {
+		t.Error(cond.Value(c))
+	}
+	// Without history the score is unknown, not zero
+	cond, _ = ParseCondition("signup.day anomaly 168 < 1")
+	if v, firing, err := cond.Eval(c, Now()); firing || err != ErrHistory {
+		t.Error(v, firing, err)
+	}
+}
+
+func TestDetectHourOfDay(t *testing.T) {
+	seconds = 100*24*60*60 + 30*60
+	c := NewCounter(nil)
+	c.Created = c.SlotTime(BucketIndex("month"), 29)
+	for i := 1; i < HourHistory; i++ {
+		c.Hours[i] = 100
+	}
+	// The same hour is quiet every day, which the previous hours don't show
+	for i := 24; i < HourHistory; i += 24 {
+		c.Hours[i] = 10
+	}
+	c.Add(Now(), 11)
+	mode := Seasons["hod"]
+	if a, err := Detect(c, BucketIndex(mode.Bucket), mode.Season, 0, 3); err != nil {
+		t.Fatal(err)
+	} else if a.Mean != 10 || a.Value != 11 || a.Anomalous {
+		t.Error(a)
+	}
+	if a, _ := Detect(c, BucketIndex("day"), 1, 0, 3); !a.Anomalous {
+		t.Error(a)
+	}
+	c.Add(Now(), 30)
+	cond, _ := ParseCondition("signup.day anomaly 24 > 3")
+	if _, firing, _ := cond.Eval(c, Now()); !firing {
+		t.Error(cond.Value(c))
+	}
+	// The history rolls with the counter
+	seconds += 24 * 60 * 60
+	c = NewCounter(c.Bytes())
+	if c.Hours[24] != 41 || c.Hours[48] != 10 {
+		t.Error(c.Hours[:49])
+	}
+}
+
+func TestDetectNew(t *testing.T) {
+	seconds = 100*24*60*60 + 30*60
+	c := NewCounter(nil)
+	for i := 0; i < 5; i++ {
+		c.Incr()
+	}
+	// A new metric has no history, the slots before it existed are not zeros
+	for mode, season := range Seasons {
+		if a, err := Detect(c, BucketIndex(season.Bucket), season.Season, 0, 3); err != ErrHistory {
+			t.Error(mode, a, err)
+		}
+	}
+	// Nor has a metric stored before the creation time was kept
+	c.Created = time.Time{}
+	if a, err := Detect(c, BucketIndex("month"), 1, 0, 3); err != ErrHistory {
+		t.Error(a, err)
+	}
+
+	// A value for an earlier time makes the slots since then history
+	c = NewCounter(nil)
+	c.Add(Now().Add(-3*24*time.Hour), 5)
+	c.Add(Now(), 5)
+	if a, err := Detect(c, BucketIndex("day"), 24, 0, 3); err != nil || a.Mean != 0 {
+		t.Error(a, err)
+	}
+	c = NewCounter(c.Bytes())
+	if a, err := Detect(c, BucketIndex("month"), 1, 0, 3); err != nil || a.Mean != 0 {
+		t.Error(a, err)
+	}
+}
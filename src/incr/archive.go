@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ArchiveVersion is the version of the namespace archive format. Archives are
+// gzipped JSON lines: a header followed by one line per counter. Version 1
+// lacked the alignment and time zone of counters, which can't be told from
+// their slots, so such archives are rejected.
+const ArchiveVersion = 2
+
+var ErrArchive = errors.New("incompatible archive")
+
+type archiveBucket struct {
+	Name   string        `json:"name"`
+	Period time.Duration `json:"period"`
+	Size   int           `json:"size"`
+}
+
+type archiveHeader struct {
+	Version   int             `json:"version"`
+	Namespace string          `json:"namespace"`
+	TimeZone  string          `json:"timezone"`
+	Buckets   []archiveBucket `json:"buckets"`
+}
+
+// archiveCounter keeps exact counts of counting kinds and values of gauges.
+type archiveCounter struct {
+	Name    string                 `json:"name"`
+	Kind    Kind                   `json:"kind"`
+	Atime   time.Time              `json:"atime"`
+	Align   Align                  `json:"align"`
+	Created time.Time              `json:"created"`
+	Counts  map[string][]int64     `json:"counts,omitempty"`
+	Values  map[string][]Value     `json:"values,omitempty"`
+	Hists   map[string][]Histogram `json:"hists,omitempty"`
+	TopK    map[string][]TopK      `json:"topk,omitempty"`
+	Hours   []Value                `json:"hours,omitempty"`
+}
+
+// WriteArchive writes all raw counters of the namespace to w.
+func WriteArchive(s Store, ns string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	n, err := s.Namespace(ns)
+	if err != nil {
+		return err
+	}
+	header := archiveHeader{Version: ArchiveVersion, Namespace: ns, TimeZone: n.TimeZone}
+	for _, bucket := range Buckets {
+		header.Buckets = append(header.Buckets, archiveBucket(bucket))
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	if err := s.Walk(ns, func(name string, c *Counter) error {
+		ac := archiveCounter{Name: name, Kind: c.Kind, Atime: c.Atime, Align: c.Align, Created: c.Created, Hours: c.Hours}
+		for i, bucket := range Buckets {
+			if c.counting() {
+				if ac.Counts == nil {
+					ac.Counts = map[string][]int64{}
+				}
+				ac.Counts[bucket.Name] = c.Counts[i]
+			} else {
+				if ac.Values == nil {
+					ac.Values = map[string][]Value{}
+				}
+				ac.Values[bucket.Name] = c.Values[i]
+			}
+			if c.Hists != nil {
+				if ac.Hists == nil {
+					ac.Hists = map[string][]Histogram{}
+				}
+				ac.Hists[bucket.Name] = c.Hists[i]
+			}
+			if c.TopK != nil {
+				if ac.TopK == nil {
+					ac.TopK = map[string][]TopK{}
+				}
+				ac.TopK[bucket.Name] = c.TopK[i]
+			}
+		}
+		return enc.Encode(ac)
+	}); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadArchive reads counters written by WriteArchive. Buckets are matched by
+// name and must have the same period and size as the ones of this instance.
+// Counters are relabelled to Alignment and keep the time zone of the archive,
+// importing them into a namespace of another zone fails.
+func ReadArchive(r io.Reader) (map[string]*Counter, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bufio.NewReader(gz))
+	header := archiveHeader{}
+	if err := dec.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Version != ArchiveVersion {
+		return nil, fmt.Errorf("%v: version %d", ErrArchive, header.Version)
+	}
+	for _, b := range header.Buckets {
+		if i := BucketIndex(b.Name); i < 0 || archiveBucket(Buckets[i]) != b {
+			return nil, fmt.Errorf("%v: bucket %s", ErrArchive, b.Name)
+		}
+	}
+	var loc *time.Location
+	if header.TimeZone != "" {
+		if loc, err = LoadLocation(header.TimeZone); err != nil {
+			return nil, fmt.Errorf("%v: time zone %s", ErrArchive, header.TimeZone)
+		}
+	}
+
+	counters := map[string]*Counter{}
+	for {
+		ac := archiveCounter{}
+		if err := dec.Decode(&ac); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		c, err := ac.counter(loc)
+		if err != nil {
+			return nil, fmt.Errorf("%v: counter %s", err, ac.Name)
+		}
+		counters[ac.Name] = c
+	}
+	return counters, nil
+}
+
+// counter converts an archived counter of the time zone loc.
+func (ac *archiveCounter) counter(loc *time.Location) (*Counter, error) {
+	switch ac.Kind {
+	case KindCounter, KindGauge, KindTimer, KindTopK:
+	default:
+		return nil, fmt.Errorf("%v: kind %q", ErrArchive, ac.Kind)
+	}
+	c := NewCounterIn(nil, loc)
+	c.Kind, c.Atime, c.Align, c.Created = ac.Kind, ac.Atime, ac.Align, ac.Created
+	if c.counting() {
+		c.Values = nil
+		for _, bucket := range Buckets {
+			c.Counts = append(c.Counts, make([]int64, bucket.Size))
+		}
+		for name, counts := range ac.Counts {
+			i := BucketIndex(name)
+			if i < 0 || len(counts) != Buckets[i].Size {
+				return nil, ErrArchive
+			}
+			c.Counts[i] = counts
+		}
+		c.initCounts()
+	} else {
+		for name, values := range ac.Values {
+			i := BucketIndex(name)
+			if i < 0 || len(values) != Buckets[i].Size {
+				return nil, ErrArchive
+			}
+			c.Values[i] = values
+		}
+	}
+	for name, hists := range ac.Hists {
+		i := BucketIndex(name)
+		if i < 0 || len(hists) != Buckets[i].Size {
+			return nil, ErrArchive
+		}
+		c.initHists()
+		c.Hists[i] = hists
+	}
+	for name, topk := range ac.TopK {
+		i := BucketIndex(name)
+		if i < 0 || len(topk) != Buckets[i].Size {
+			return nil, ErrArchive
+		}
+		c.initTopK()
+		c.TopK[i] = topk
+	}
+	c.Hours = nil
+	if len(ac.Hours) == HourHistory {
+		c.Hours = ac.Hours
+	}
+	c.initHours()
+	c.Relabel(Alignment)
+	return c, nil
+}
+
+func exportArchive(c *gin.Context, s Store) {
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.incr.gz"`, c.Param("ns")))
+	c.Status(200)
+	if err := WriteArchive(s, c.Param("ns"), c.Writer); err != nil {
+		log.Println(err)
+	}
+}
+
+func importArchive(c *gin.Context, s Store) {
+	counters, err := ReadArchive(c.Request.Body)
+	if err != nil {
+		c.AbortWithError(400, err)
+	} else if err := s.Import(c.Param("ns"), counters); err != nil {
+		c.AbortWithError(409, err)
+	} else {
+		c.JSON(200, gin.H{"imported": len(counters)})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+
+	seconds = 0
+	s.Incr("foo", "bar")
+	s.Incr("foo", "bar")
+	s.Apply("foo", []Event{{Metric: "temp", Type: KindGauge, Value: 20}})
+	b := &bytes.Buffer{}
+	if err := WriteArchive(s, "foo", b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another tenant already has data, archive is imported 5 seconds later
+	seconds = 3
+	s.Incr("baz", "bar")
+	seconds = 5
+	counters, err := ReadArchive(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Import("baz", counters); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := s.Query("baz", "bar")
+	if c.Values[BucketIndex("total")][0] != 3 {
+		t.Error(c.Values[BucketIndex("total")])
+	} else if c.Values[BucketIndex("realtime")][2] != 1 || c.Values[BucketIndex("realtime")][5] != 2 {
+		t.Error(c.Values[BucketIndex("realtime")])
+	}
+	if c, _ := s.Query("baz", "temp"); c.Kind != KindGauge || c.Values[BucketIndex("total")][0] != 20 {
+		t.Error(c.Kind, c.Values[BucketIndex("total")])
+	}
+
+	// Kinds must match
+	s.Apply("qux", []Event{{Metric: "temp", Value: 1}})
+	if err := s.Import("qux", counters); err == nil {
+		t.Error("imported gauge into counter")
+	}
+}
+
+func TestArchiveExact(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+	s.PutNamespace(&Namespace{Name: "berlin", TimeZone: "Europe/Berlin"})
+
+	// Counts beyond 2^53 don't fit float64 values
+	seconds = 0
+	s.Apply("foo", []Event{{Metric: "bar", Value: 1 << 53}, {Metric: "bar", Value: 1}})
+	b := &bytes.Buffer{}
+	if err := WriteArchive(s, "foo", b); err != nil {
+		t.Fatal(err)
+	}
+	archive := b.Bytes()
+	counters, err := ReadArchive(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Import("baz", counters); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := s.Query("baz", "bar"); c.Counts[BucketIndex("total")][0] != 1<<53+1 {
+		t.Error(c.Counts[BucketIndex("total")])
+	}
+	// Slots of fixed periods don't line up with the calendar of a time zone
+	counters, _ = ReadArchive(bytes.NewReader(archive))
+	if err := s.Import("berlin", counters); err == nil {
+		t.Error("imported into another time zone")
+	}
+}
+
+func TestArchiveInvalid(t *testing.T) {
+	archive := func(lines ...string) *bytes.Buffer {
+		b := &bytes.Buffer{}
+		gz := gzip.NewWriter(b)
+		gz.Write([]byte(strings.Join(lines, "\n")))
+		gz.Close()
+		return b
+	}
+	header := `{"version": 2, "namespace": "foo", "buckets": [{"name": "total", "period": 9223372036854775807, "size": 1}]}`
+	if _, err := ReadArchive(archive(header, `{"name": "bar", "kind": "c", "counts": {"total": [3]}}`)); err != nil {
+		t.Error(err)
+	}
+	for _, lines := range [][]string{
+		{`{"version": 1, "namespace": "foo"}`},
+		{header, `{"name": "bar", "kind": "d", "values": {"total": [3]}}`},
+		{header, `{"name": "bar", "counts": {"total": [3]}}`},
+		{header, `{"name": "bar", "kind": "c", "counts": {"total": [3, 4]}}`},
+		{`{"version": 2, "namespace": "foo", "timezone": "Mars/Olympus"}`},
+	} {
+		if _, err := ReadArchive(archive(lines...)); err == nil {
+			t.Error(lines)
+		}
+	}
+}
+
+func TestArchiveAlign(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+
+	// Archives of legacy counters are relabelled like stored ones
+	seconds = 3*3600 + 40*60
+	legacy := NewCounter(nil)
+	legacy.Align = AlignRound
+	legacy.Add(time.Unix(3*3600+10*60, 0), 1)
+	legacy.Add(time.Unix(3*3600+35*60, 0), 1)
+	s.Import("foo", map[string]*Counter{"bar": legacy})
+	b := &bytes.Buffer{}
+	WriteArchive(s, "foo", b)
+	counters, err := ReadArchive(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := counters["bar"]; c.Align != AlignTruncate || c.Values[BucketIndex("day")][0] != 2 {
+		t.Error(c.Align, c.Values[BucketIndex("day")][:2])
+	}
+}
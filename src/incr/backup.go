@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+)
+
+const backupTimeFormat = "20060102T150405"
+
+func backup(c *gin.Context, s Store) {
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="incr-%s.db"`,
+		Now().UTC().Format(backupTimeFormat)))
+	c.Status(200)
+	if _, err := s.Backup(c.Writer); err != nil {
+		log.Println(err)
+	}
+}
+
+// Restore replaces the database at path with the snapshot read from r. The
+// snapshot is checked to be a valid bolt file before the old database is
+// replaced, and the database must not be in use by a running server. The
+// restored database gets a new epoch, so that a write-ahead log left by the
+// old one isn't replayed into it.
+func Restore(path string, r io.Reader) error {
+	if db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second}); err != nil {
+		return fmt.Errorf("database is in use: %v", err)
+	} else {
+		db.Close()
+	}
+
+	tmp := path + ".restore"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if db, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: time.Second}); err != nil {
+		return fmt.Errorf("invalid snapshot: %v", err)
+	} else if err := db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(IncrBucket) == nil {
+			return ErrNotFound
+		}
+		b, err := tx.CreateBucketIfNotExists(WALBucket)
+		if err != nil {
+			return err
+		}
+		epoch := make([]byte, 8)
+		binary.BigEndian.PutUint64(epoch, uint64(time.Now().UnixNano()))
+		return b.Put(walEpochKey, epoch)
+	}); err != nil {
+		db.Close()
+		return fmt.Errorf("invalid snapshot: %v", err)
+	} else {
+		db.Close()
+	}
+	return os.Rename(tmp, path)
+}
+
+// Snapshot writes a backup into dir and keeps only the latest keep snapshots.
+func Snapshot(s Store, dir string, keep int) error {
+	name := filepath.Join(dir, "incr-"+Now().UTC().Format(backupTimeFormat)+".db")
+	f, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Backup(f); err != nil {
+		f.Close()
+		os.Remove(name + ".tmp")
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(name + ".tmp")
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+
+	// Snapshot names sort by time, oldest first
+	snapshots, err := filepath.Glob(filepath.Join(dir, "incr-*.db"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(snapshots)
+	for len(snapshots) > keep {
+		if err := os.Remove(snapshots[0]); err != nil {
+			return err
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// scheduleSnapshots takes snapshots into INCRBACKUPDIR every
+// INCRBACKUPINTERVAL (24h by default) keeping INCRBACKUPKEEP (7) of them.
+func scheduleSnapshots(s Store) {
+	dir := os.Getenv("INCRBACKUPDIR")
+	if dir == "" {
+		return
+	}
+	interval := 24 * time.Hour
+	if v := os.Getenv("INCRBACKUPINTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil {
+			log.Fatal(err)
+		} else {
+			interval = d
+		}
+	}
+	keep := 7
+	if v := os.Getenv("INCRBACKUPKEEP"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			log.Fatal("invalid INCRBACKUPKEEP: ", v)
+		} else {
+			keep = n
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := Snapshot(s, dir, keep); err != nil {
+				log.Println("snapshot:", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+	s.Incr("foo", "bar")
+	b := &bytes.Buffer{}
+	if _, err := s.Backup(b); err != nil {
+		t.Fatal(err)
+	}
+	s.(*store).db.Close()
+
+	restored := tempPath(t, "restored.db")
+	if err := Restore(restored, bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = NewStore(restored)
+	if c, err := s.Query("foo", "bar"); err != nil {
+		t.Error(err)
+	} else if c.Values[BucketIndex("total")][0] != 1 {
+		t.Error(c.Values[BucketIndex("total")])
+	}
+	s.(*store).db.Close()
+	if err := Restore(restored, bytes.NewBufferString("garbage")); err == nil {
+		t.Error("restored invalid snapshot")
+	} else if _, err := os.Stat(restored); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotRotation(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	dir := tempDir(t)
+	s, _ := NewStore(dbPath)
+	for i := 0; i < 5; i++ {
+		seconds = i
+		if err := Snapshot(s, dir, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshots, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(snapshots) != 3 {
+		t.Error(snapshots)
+	} else if filepath.Base(snapshots[0]) != "incr-19700101T000002.db" {
+		t.Error(snapshots)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	defer os.Setenv("INCRADMINTOKEN", os.Getenv("INCRADMINTOKEN"))
+	e := gin.New()
+	e.GET("/admin/backup", adminHandler, func(c *gin.Context) {
+		c.String(200, "snapshot")
+	})
+	get := func(auth string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/admin/backup", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		e.ServeHTTP(w, req)
+		return w.Code
+	}
+	os.Setenv("INCRADMINTOKEN", "")
+	if code := get(""); code != 403 {
+		t.Error("admin routes are open without a token", code)
+	}
+	os.Setenv("INCRADMINTOKEN", "secret")
+	if code := get("Bearer wrong"); code != 401 {
+		t.Error(code)
+	}
+	if code := get("Bearer secret"); code != 200 {
+		t.Error(code)
+	}
+}
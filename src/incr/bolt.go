@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// boltBackend keeps records in a bolt database file, it is the default.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func OpenBolt(path string) (Backend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackend{db: db}, nil
+}
+
+func (b *boltBackend) View(fn func(tx KVTx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+func (b *boltBackend) Update(fn func(tx KVTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error { return fn(boltTx{tx}) })
+}
+
+// Backup writes a consistent snapshot of the database while writes keep
+// going.
+func (b *boltBackend) Backup(w io.Writer) (n int64, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// DeferSync stops syncing every transaction, see Sync. Committed pages then
+// survive a crash of the process but not a power loss or a crash of the OS,
+// which may leave the file corrupted beyond what the write-ahead log can
+// repair.
+func (b *boltBackend) DeferSync() {
+	b.db.NoSync = true
+}
+
+func (b *boltBackend) Sync() error {
+	return b.db.Sync()
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+func (tx boltTx) Bucket(name []byte) KVBucket {
+	if b := tx.tx.Bucket(name); b != nil {
+		return boltBucket{b}
+	}
+	return nil
+}
+
+func (tx boltTx) CreateBucketIfNotExists(name []byte) (KVBucket, error) {
+	b, err := tx.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (tx boltTx) DeleteBucket(name []byte) error {
+	return tx.tx.DeleteBucket(name)
+}
+
+func (tx boltTx) ForEach(fn func(name []byte, b KVBucket) error) error {
+	return tx.tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fn(name, boltBucket{b})
+	})
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) Cursor() KVCursor {
+	return b.b.Cursor()
+}
+
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+// KeyN adds up the key counts of the pages of the bucket, which doesn't
+// decode any values.
+func (b boltBucket) KeyN() int {
+	return b.b.Stats().KeyN
+}
+
+func (b boltBucket) Bucket(name []byte) KVBucket {
+	if nested := b.b.Bucket(name); nested != nil {
+		return boltBucket{nested}
+	}
+	return nil
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (KVBucket, error) {
+	nested, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{nested}, nil
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
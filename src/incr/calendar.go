@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var locations = struct {
+	sync.Mutex
+	m map[string]*time.Location
+}{m: map[string]*time.Location{}}
+
+// LoadLocation is time.LoadLocation with a cache, it is called for every
+// counter of a namespace with a time zone.
+func LoadLocation(name string) (*time.Location, error) {
+	locations.Lock()
+	defer locations.Unlock()
+	if loc, ok := locations.m[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.m[name] = loc
+	return loc, nil
+}
+
+// Counters of namespaces with a time zone follow the calendar of that zone:
+// "day" slots start at the top of each local hour, "month" slots at local
+// midnight (so days are 23 or 25 hours long around DST changes) and "year"
+// slots on the first day of each month. Counters without a time zone keep the
+// fixed periods of Buckets.
+
+func floorDiv(a, b int64) int64 {
+	if a < 0 {
+		return (a - b + 1) / b
+	}
+	return a / b
+}
+
+// hourStart is the start of the local hour of t. It is computed from the
+// local clock rather than time.Date, which is ambiguous when clocks go back.
+func hourStart(t time.Time) time.Time {
+	return t.Add(-time.Duration(t.Minute())*time.Minute -
+		time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+}
+
+// calendarPeriod numbers the periods of bucket i by the calendar of loc, so
+// that the number of periods between two times is a difference.
+func calendarPeriod(i int, t time.Time, loc *time.Location) int64 {
+	t = t.In(loc)
+	switch Buckets[i].Name {
+	case "realtime":
+		return t.Unix()
+	case "day":
+		return floorDiv(hourStart(t).Unix(), 3600)
+	case "month":
+		y, m, d := t.Date()
+		return floorDiv(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix(), 24*3600)
+	case "year":
+		y, m, _ := t.Date()
+		return int64(y)*12 + int64(m) - 1
+	default:
+		return 0
+	}
+}
+
+// calendarStart returns the start of the period of bucket i that is slot
+// periods before the one t falls into.
+func calendarStart(i int, t time.Time, slot int, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch Buckets[i].Name {
+	case "realtime":
+		return t.Truncate(time.Second).Add(-time.Duration(slot) * time.Second)
+	case "day":
+		return hourStart(t).Add(-time.Duration(slot) * time.Hour)
+	case "month":
+		return time.Date(y, m, d-slot, 0, 0, 0, 0, loc)
+	case "year":
+		return time.Date(y, m-time.Month(slot), 1, 0, 0, 0, 0, loc)
+	default:
+		return t
+	}
+}
+
+// periods returns the number of periods of bucket i that passed from one time
+// to another.
+func (c *Counter) periods(i int, from, to time.Time) int {
+	if bucket := Buckets[i]; bucket.Size == 1 {
+		return 0
+	} else if c.loc == nil {
+		return int(c.align(to, bucket.Period).Sub(c.align(from, bucket.Period)) / bucket.Period)
+	}
+	return int(calendarPeriod(i, to, c.loc) - calendarPeriod(i, from, c.loc))
+}
+
+// align returns the start of the fixed period d that t falls into.
+func (c *Counter) align(t time.Time, d time.Duration) time.Time {
+	if c.Align == AlignRound {
+		return t.Round(d)
+	}
+	return t.Truncate(d)
+}
+
+// Location returns the time zone of the counter, UTC if it has none.
+func (c *Counter) Location() *time.Location {
+	if c.loc == nil {
+		return time.UTC
+	}
+	return c.loc
+}
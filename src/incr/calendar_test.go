@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func setNow(t time.Time) {
+	seconds = int(t.Unix())
+}
+
+func TestCalendarDST(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+	if err := s.PutNamespace(&Namespace{Name: "foo", TimeZone: "Europe/Berlin"}); err != nil {
+		t.Fatal(err)
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	day, month := BucketIndex("day"), BucketIndex("month")
+
+	// Clocks go forward at 02:00, 01:30 and 03:30 are an hour apart
+	setNow(time.Date(2016, 3, 26, 23, 30, 0, 0, berlin))
+	s.Incr("foo", "spring")
+	setNow(time.Date(2016, 3, 27, 1, 30, 0, 0, berlin))
+	s.Incr("foo", "spring")
+	setNow(time.Date(2016, 3, 27, 3, 30, 0, 0, berlin))
+	s.Incr("foo", "spring")
+	c, _ := s.Query("foo", "spring")
+	if v := c.Values[day]; v[0] != 1 || v[1] != 1 || v[2] != 0 || v[3] != 1 {
+		t.Error(v)
+	}
+	// 23:30 on the 26th is 22:30 UTC, still the previous day in Berlin
+	if v := c.Values[month]; v[0] != 2 || v[1] != 1 {
+		t.Error(v)
+	}
+	if start := c.SlotTime(month, 0); !start.Equal(time.Date(2016, 3, 27, 0, 0, 0, 0, berlin)) {
+		t.Error(start)
+	}
+	if start := c.SlotTime(day, 1); !start.Equal(time.Date(2016, 3, 27, 1, 0, 0, 0, berlin)) {
+		t.Error(start)
+	}
+
+	// Clocks go back at 03:00, 02:30 happens twice and the day has 25 hours
+	first := time.Date(2016, 10, 30, 0, 30, 0, 0, time.UTC)
+	setNow(time.Date(2016, 10, 30, 0, 0, 0, 0, berlin))
+	s.Incr("foo", "fall")
+	setNow(first)
+	s.Incr("foo", "fall")
+	setNow(first.Add(time.Hour))
+	s.Incr("foo", "fall")
+	setNow(time.Date(2016, 10, 30, 23, 59, 0, 0, berlin))
+	s.Incr("foo", "fall")
+	c, _ = s.Query("foo", "fall")
+	if v := c.Values[day]; v[0] != 1 || v[21] != 1 || v[22] != 1 || v[23] != 0 {
+		t.Error(v)
+	}
+	if v := c.Values[month]; v[0] != 4 || v[1] != 0 {
+		t.Error(v)
+	}
+}
+
+func TestCalendarMonths(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+	s.PutNamespace(&Namespace{Name: "foo", TimeZone: "Europe/Berlin"})
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	year := BucketIndex("year")
+
+	// 30 days apart, but the same month
+	setNow(time.Date(2016, 1, 1, 0, 30, 0, 0, berlin))
+	s.Incr("foo", "bar")
+	setNow(time.Date(2016, 1, 31, 23, 30, 0, 0, berlin))
+	s.Incr("foo", "bar")
+	// An hour later, but the next month
+	setNow(time.Date(2016, 2, 1, 0, 30, 0, 0, berlin))
+	s.Incr("foo", "bar")
+	// February has 29 days in 2016
+	setNow(time.Date(2016, 3, 1, 0, 0, 0, 0, berlin))
+	s.Incr("foo", "bar")
+
+	c, _ := s.Query("foo", "bar")
+	if v := c.Values[year]; v[0] != 1 || v[1] != 1 || v[2] != 2 || v[3] != 0 {
+		t.Error(v)
+	}
+	if start := c.SlotTime(year, 2); !start.Equal(time.Date(2016, 1, 1, 0, 0, 0, 0, berlin)) {
+		t.Error(start)
+	}
+
+	// A year later every month slot is rolled out
+	setNow(time.Date(2017, 3, 1, 0, 0, 0, 0, berlin))
+	c, _ = s.Query("foo", "bar")
+	if v := c.Values[year]; v[0] != 0 || v[11] != 0 || c.Values[BucketIndex("total")][0] != 4 {
+		t.Error(v)
+	}
+
+	// Namespaces without a time zone keep fixed periods
+	if n, _ := s.Namespace("bar"); n.TimeZone != "" || n.Location() != nil {
+		t.Error(n)
+	}
+	if err := s.PutNamespace(&Namespace{Name: "bar", TimeZone: "Mars/Olympus"}); err == nil {
+		t.Error("saved invalid time zone")
+	}
+}
+
+func TestCalendarAlert(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	c := NewCounterIn(nil, berlin)
+	cond, _ := ParseCondition("signup.day slot 0 < 10 by 18:00")
+	// 17:30 UTC is 19:30 in Berlin in summer
+	if _, firing, _ := cond.Eval(c, time.Date(2016, 6, 1, 17, 30, 0, 0, time.UTC)); !firing {
+		t.Error("did not fire after 18:00 local time")
+	}
+	if _, firing, _ := cond.Eval(c, time.Date(2016, 6, 1, 15, 30, 0, 0, time.UTC)); firing {
+		t.Error("fired before 18:00 local time")
+	}
+}
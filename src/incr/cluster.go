@@ -0,0 +1,168 @@
+package main
+
+import (
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RingReplicas is the number of points every node has on the hash ring, more
+// points spread namespaces more evenly.
+var RingReplicas = 64
+
+// ForwardedHeader marks requests forwarded by another node, they are always
+// served locally so that nodes with different membership don't loop. It is
+// ignored on requests that don't come from one of the nodes.
+const ForwardedHeader = "X-Incr-Forwarded"
+
+// Ring assigns namespaces to nodes by consistent hashing, so that adding or
+// removing a node only moves the namespaces of that node.
+type Ring struct {
+	Self    string
+	members []string
+	hashes  []uint32
+	nodes   map[uint32]string
+
+	mu      sync.Mutex
+	proxies map[string]*httputil.ReverseProxy
+	// addrs are resolved addresses of the nodes
+	addrs map[string][]string
+}
+
+// NewRing builds a ring of the nodes, given as base URLs. Self is the URL of
+// this node, it must be one of the nodes.
+func NewRing(self string, nodes []string) *Ring {
+	r := &Ring{Self: self, members: nodes, nodes: map[uint32]string{}, proxies: map[string]*httputil.ReverseProxy{}, addrs: map[string][]string{}}
+	for _, node := range nodes {
+		for i := 0; i < RingReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			r.hashes = append(r.hashes, h)
+			r.nodes[h] = node
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owner returns the URL of the node that keeps the namespace.
+func (r *Ring) Owner(ns string) string {
+	if len(r.hashes) == 0 {
+		return r.Self
+	}
+	h := crc32.ChecksumIEEE([]byte(ns))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+func (r *Ring) proxy(node string) (*httputil.ReverseProxy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.proxies[node]; ok {
+		return p, nil
+	}
+	u, err := url.Parse(node)
+	if err != nil {
+		return nil, err
+	}
+	p := httputil.NewSingleHostReverseProxy(u)
+	// Exports are streamed
+	p.FlushInterval = 100 * time.Millisecond
+	// CORS headers are already set by this node
+	p.ModifyResponse = func(resp *http.Response) error {
+		for h := range resp.Header {
+			if strings.HasPrefix(h, "Access-Control-") {
+				resp.Header.Del(h)
+			}
+		}
+		return nil
+	}
+	r.proxies[node] = p
+	return p, nil
+}
+
+// fromNode tells if the request comes from the address of one of the nodes.
+// Addresses are resolved once, nodes that don't resolve yet are tried again
+// with the next request.
+func (r *Ring) fromNode(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, node := range r.members {
+		addrs, ok := r.addrs[node]
+		if !ok {
+			u, err := url.Parse(node)
+			if err != nil {
+				continue
+			}
+			if addrs, err = net.LookupHost(u.Hostname()); err != nil {
+				continue
+			}
+			r.addrs[node] = addrs
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr).Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParsePeers splits a comma separated list of node URLs.
+func ParsePeers(peers string) []string {
+	nodes := []string{}
+	for _, node := range strings.Split(peers, ",") {
+		if node = strings.TrimSuffix(strings.TrimSpace(node), "/"); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// clusterHandler forwards requests for namespaces kept by other nodes to
+// their owner, both reads and writes.
+func clusterHandler(r *Ring) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ns := c.Param("ns")
+		if ns == "" {
+			c.Next()
+			return
+		}
+		if c.Request.Header.Get(ForwardedHeader) != "" {
+			if r.fromNode(c.Request) {
+				c.Next()
+				return
+			}
+			c.Request.Header.Del(ForwardedHeader)
+		}
+		owner := r.Owner(ns)
+		if owner == r.Self {
+			c.Next()
+			return
+		}
+		p, err := r.proxy(owner)
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		c.Request.Header.Set(ForwardedHeader, r.Self)
+		p.ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRing(t *testing.T) {
+	nodes := []string{"http://a", "http://b", "http://c"}
+	r := NewRing("http://a", nodes)
+	owned := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		owned[r.Owner(fmt.Sprintf("ns%d", i))]++
+	}
+	for _, node := range nodes {
+		if owned[node] < 500 {
+			t.Error(owned)
+		}
+	}
+
+	// Adding a node only moves namespaces to the new node
+	grown := NewRing("http://a", append(nodes, "http://d"))
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		ns := fmt.Sprintf("ns%d", i)
+		if before, after := r.Owner(ns), grown.Owner(ns); before != after {
+			moved++
+			if after != "http://d" {
+				t.Error(ns, before, after)
+			}
+		}
+	}
+	if moved == 0 || moved > 1500 {
+		t.Error(moved)
+	}
+	if owner := NewRing("http://a", nil).Owner("foo"); owner != "http://a" {
+		t.Error(owner)
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	if peers := ParsePeers(" http://a/, http://b,,"); len(peers) != 2 || peers[0] != "http://a" || peers[1] != "http://b" {
+		t.Error(peers)
+	}
+}
+
+func TestClusterForward(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var ring *Ring
+	servers := []*httptest.Server{}
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprint(i)
+		e := gin.New()
+		e.Use(corsHandler, func(c *gin.Context) { clusterHandler(ring)(c) })
+		e.GET("/api/:ns", func(c *gin.Context) {
+			c.String(200, name+" "+c.Request.Header.Get(ForwardedHeader))
+		})
+		servers = append(servers, httptest.NewServer(e))
+		defer servers[i].Close()
+	}
+	ring = NewRing(servers[0].URL, []string{servers[0].URL, servers[1].URL})
+
+	for i := 0; i < 10; i++ {
+		ns := fmt.Sprintf("ns%d", i)
+		req, _ := http.NewRequest("GET", servers[0].URL+"/api/"+ns, nil)
+		req.Header.Set("Origin", "http://dashboard")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if origin := resp.Header["Access-Control-Allow-Origin"]; len(origin) != 1 || origin[0] != "http://dashboard" {
+			t.Error(ns, origin)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		want := "0 "
+		if ring.Owner(ns) == servers[1].URL {
+			want = "1 " + servers[0].URL
+		}
+		if string(body) != want {
+			t.Error(ns, string(body), want)
+		}
+	}
+
+	// Forwarded requests are served locally
+	req, _ := http.NewRequest("GET", servers[0].URL+"/api/x", nil)
+	req.Header.Set(ForwardedHeader, "elsewhere")
+	for i := 0; ring.Owner(req.URL.Path[5:]) == servers[0].URL; i++ {
+		req.URL.Path = fmt.Sprintf("/api/x%d", i)
+	}
+	resp, _ := http.DefaultClient.Do(req)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "0 elsewhere" {
+		t.Error(string(body))
+	}
+}
+
+func TestRingFromNode(t *testing.T) {
+	r := NewRing("http://127.0.0.1:8000", []string{"http://127.0.0.1:8000", "http://127.0.0.2:8000"})
+	for addr, want := range map[string]bool{
+		"127.0.0.1:1234": true,
+		"127.0.0.2:1234": true,
+		"192.0.2.1:1234": false,
+		"garbage":        false,
+	} {
+		req := httptest.NewRequest("GET", "/api/foo", nil)
+		req.RemoteAddr = addr
+		if r.fromNode(req) != want {
+			t.Error(addr, want)
+		}
+	}
+
+	// Clients can't make a node serve namespaces of others, these are
+	// forwarded to the owner, here a node that is down
+	other := NewRing("http://127.0.0.2:8000", []string{"http://127.0.0.2:8000", "http://127.0.0.2:1"})
+	e := gin.New()
+	e.Use(clusterHandler(other))
+	e.GET("/api/:ns", func(c *gin.Context) {
+		c.String(200, "local")
+	})
+	server := httptest.NewServer(e)
+	defer server.Close()
+	for i := 0; i < 10; i++ {
+		ns := fmt.Sprintf("ns%d", i)
+		req, _ := http.NewRequest("GET", server.URL+"/api/"+ns, nil)
+		req.Header.Set(ForwardedHeader, "http://127.0.0.2:1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if local := string(body) == "local"; local != (other.Owner(ns) == other.Self) {
+			t.Error(ns, resp.StatusCode, string(body))
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testStores are all Store implementations, every test run with
+// forEachStore checks that they behave the same.
+// Stores keep their files in dir.
+var testStores = []struct {
+	Name string
+	Open func(dir string) (Store, func())
+}{
+	{"bolt", func(dir string) (Store, func()) {
+		s, err := NewStore(filepath.Join(dir, "test.db"))
+		if err != nil {
+			panic(err)
+		}
+		return s, func() {
+			s.(*store).db.Close()
+		}
+	}},
+	{"log", func(dir string) (Store, func()) {
+		s, err := Open("log://" + filepath.Join(dir, "test.db"))
+		if err != nil {
+			panic(err)
+		}
+		return s, func() {
+			s.(*store).db.Close()
+		}
+	}},
+	{"mem", func(dir string) (Store, func()) {
+		s, _ := Open("mem://")
+		return s, func() {}
+	}},
+	{"wal", func(dir string) (Store, func()) {
+		db, _ := OpenMem("")
+		s, err := NewWALStore(filepath.Join(dir, "test.wal"), db)
+		if err != nil {
+			panic(err)
+		}
+		return s, func() {
+			s.(*walStore).Close()
+		}
+	}},
+}
+
+func forEachStore(t *testing.T, fn func(t *testing.T, s Store)) {
+	for _, impl := range testStores {
+		t.Run(impl.Name, func(t *testing.T) {
+			s, closer := impl.Open(tempDir(t))
+			defer closer()
+			fn(t, s)
+		})
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if _, err := s.Query("foo", "bar"); err != ErrNotFound {
+			t.Error(err)
+		}
+		if err := s.DeleteRule("foo", "1"); err != ErrNotFound {
+			t.Error(err)
+		}
+		if err := s.DeleteDerived("foo", "bar"); err != ErrNotFound {
+			t.Error(err)
+		}
+		s.Incr("foo", "bar")
+		if err := s.PutDerived("foo", "bar", "baz * 2"); err != ErrExists {
+			t.Error(err)
+		}
+		if err := s.PutNamespace(&Namespace{Name: "foo", TimeZone: "Mars/Olympus"}); err == nil {
+			t.Error("invalid time zone accepted")
+		}
+	})
+}
+
+// Namespaces used to share one bucket keyed by "ns:name", so namespace
+// "foo" also listed metrics of "foo:bar".
+func TestStoreNamespaceCollision(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		s.Incr("foo", "a")
+		s.Incr("foo:bar", "b")
+		s.PutDerived("foo:bar", "c", "b * 2")
+		s.PutRule(&Rule{NS: "foo:bar", Expr: "b > 1"})
+		if list, _ := s.List("foo"); len(list) != 1 || list[0].Name != "a" {
+			t.Error(list)
+		}
+		if list, _ := s.List("foo:bar"); len(list) != 2 || list[0].Name != "b" || list[1].Name != "c" {
+			t.Error(list)
+		}
+		if _, err := s.Query("foo", "bar:b"); err != ErrNotFound {
+			t.Error(err)
+		}
+		if d, _ := s.Derived("foo"); len(d) != 0 {
+			t.Error(d)
+		}
+		if rules, _ := s.Rules("foo"); len(rules) != 0 {
+			t.Error(rules)
+		}
+		if rules, _ := s.Rules(""); len(rules) != 1 {
+			t.Error(rules)
+		}
+		n := 0
+		s.Walk("foo", func(name string, c *Counter) error {
+			n++
+			return nil
+		})
+		if n != 1 {
+			t.Error(n)
+		}
+	})
+}
+
+func TestStoreListDerived(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		s.Incr("foo", "b")
+		s.Incr("foo", "d")
+		s.Incr("foobar", "a")
+		s.PutDerived("foo", "c", "b + d")
+		s.PutDerived("foo", "a", "b * 2")
+		list, _ := s.List("foo")
+		if len(list) != 4 || list[0].Name != "a" || !list[0].Derived ||
+			list[1].Name != "b" || list[2].Name != "c" || !list[2].Derived || list[3].Name != "d" {
+			t.Error(list)
+		}
+		if c, err := s.Query("foo", "a"); err != nil || c.Kind != KindDerived || c.Values[BucketIndex("total")][0] != 2 {
+			t.Error(c, err)
+		}
+		if derived, _ := s.Derived("foo"); len(derived) != 2 || derived["c"] != "b + d" {
+			t.Error(derived)
+		}
+
+		// Derived metrics can't be shadowed by new counters later
+		if err := s.Incr("foo", "a"); err == nil {
+			t.Error("counter shadows a derived metric")
+		}
+		err := s.Apply("foo", []Event{{Metric: "b", Value: 1}, {Metric: "c", Value: 1}})
+		if e, ok := err.(*ItemError); !ok || e.Index != 1 || e.Err != ErrDerived {
+			t.Error(err)
+		}
+		if list, _ := s.List("foo"); len(list) != 4 {
+			t.Error(list)
+		}
+		if c, _ := s.Query("foo", "b"); c.Values[BucketIndex("total")][0] != 1 {
+			t.Error(c.Values)
+		}
+		// Nor by imported ones
+		imported := NewCounter(nil)
+		imported.Incr()
+		if err := s.Import("foo", map[string]*Counter{"b": NewCounter(nil), "c": imported}); err != ErrDerived {
+			t.Error(err)
+		}
+		if c, err := s.Query("foo", "c"); err != nil || c.Kind != KindDerived {
+			t.Error(c, err)
+		}
+		if c, _ := s.Query("foo", "b"); c.Values[BucketIndex("total")][0] != 1 {
+			t.Error(c.Values)
+		}
+	})
+}
+
+func TestStoreRules(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		a := &Rule{NS: "foo", Name: "a", Expr: "bar.day slot 0 > 1"}
+		b := &Rule{NS: "bar", Name: "b", Expr: "bar.day slot 0 > 1"}
+		s.PutRule(a)
+		s.PutRule(b)
+		if a.ID == "" || a.ID == b.ID {
+			t.Error(a.ID, b.ID)
+		}
+		if rules, _ := s.Rules("foo"); len(rules) != 1 || rules[0].Name != "a" {
+			t.Error(rules)
+		}
+		if rules, _ := s.Rules(""); len(rules) != 2 {
+			t.Error(rules)
+		}
+		if err := s.DeleteRule("foo", a.ID); err != nil {
+			t.Error(err)
+		}
+		if rules, _ := s.Rules("foo"); len(rules) != 0 {
+			t.Error(rules)
+		}
+
+		// States of deleted rules and namespaces are not saved
+		b.State, b.Name = StateFiring, "renamed"
+		if err := s.PutRuleState(b); err != nil {
+			t.Error(err)
+		}
+		if rules, _ := s.Rules("bar"); len(rules) != 1 || rules[0].State != StateFiring || rules[0].Name != "b" {
+			t.Error(rules)
+		}
+		a.State = StateFiring
+		if err := s.PutRuleState(a); err != ErrNotFound {
+			t.Error(err)
+		}
+		s.DeleteNamespace("bar")
+		if err := s.PutRuleState(b); err != ErrNotFound {
+			t.Error(err)
+		}
+		if rules, _ := s.Rules(""); len(rules) != 0 {
+			t.Error(rules)
+		}
+		if list, _ := s.Namespaces(); len(list) != 1 || list[0].Name != "foo" {
+			t.Error(list)
+		}
+	})
+}
+
+func TestStoreNamespace(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if n, err := s.Namespace("foo"); err != nil || n.Name != "foo" || n.TimeZone != "" {
+			t.Error(n, err)
+		}
+		s.PutNamespace(&Namespace{Name: "foo", TimeZone: "Europe/Berlin"})
+		if n, _ := s.Namespace("foo"); n.TimeZone != "Europe/Berlin" {
+			t.Error(n)
+		}
+		s.Incr("foo", "bar")
+		if c, _ := s.Query("foo", "bar"); c.Location().String() != "Europe/Berlin" {
+			t.Error(c.Location())
+		}
+		// Slots of existing counters would change their meaning
+		if err := s.PutNamespace(&Namespace{Name: "foo", TimeZone: "UTC"}); err != ErrTimeZone {
+			t.Error(err)
+		}
+		if err := s.PutNamespace(&Namespace{Name: "foo", TimeZone: "Europe/Berlin", Owner: "me"}); err != nil {
+			t.Error(err)
+		}
+		if n, _ := s.Namespace("foo"); n.TimeZone != "Europe/Berlin" || n.Owner != "me" {
+			t.Error(n)
+		}
+	})
+}
+
+func TestStoreNamespaces(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seconds = 100
+		s.Incr("foo", "a")
+		s.Incr("foo", "b")
+		s.PutRule(&Rule{NS: "foo", Expr: "a > 1"})
+		seconds = 200
+		if err := s.CreateNamespace(&Namespace{Name: "bar", Owner: "team-bar", Retention: "24h"}); err != nil {
+			t.Error(err)
+		}
+		if err := s.CreateNamespace(&Namespace{Name: "foo"}); err != ErrExists {
+			t.Error(err)
+		}
+		if err := s.CreateNamespace(&Namespace{Name: "baz", Retention: "a month"}); err == nil {
+			t.Error("invalid retention accepted")
+		}
+		list, _ := s.Namespaces()
+		if len(list) != 2 || list[0].Name != "bar" || list[1].Name != "foo" {
+			t.Fatal(list)
+		}
+		if list[0].Owner != "team-bar" || list[0].Created.Unix() != 200 || list[0].Metrics != 0 {
+			t.Error(list[0])
+		}
+		if list[1].Created.Unix() != 100 || list[1].Metrics != 2 {
+			t.Error(list[1])
+		}
+		// Updates keep the creation time
+		seconds = 300
+		s.PutNamespace(&Namespace{Name: "foo", DisplayName: "Foo"})
+		if n, _ := s.Namespace("foo"); n.DisplayName != "Foo" || n.Created.Unix() != 100 {
+			t.Error(n)
+		}
+
+		if err := s.DeleteNamespace("foo"); err != nil {
+			t.Error(err)
+		}
+		if err := s.DeleteNamespace("foo"); err != ErrNotFound {
+			t.Error(err)
+		}
+		if list, _ := s.List("foo"); len(list) != 0 {
+			t.Error(list)
+		}
+		if rules, _ := s.Rules(""); len(rules) != 0 {
+			t.Error(rules)
+		}
+		if list, _ := s.Namespaces(); len(list) != 1 {
+			t.Error(list)
+		}
+
+		// Counts span many pages and follow deletions
+		events := []Event{}
+		for i := 0; i < 2000; i++ {
+			events = append(events, Event{Metric: fmt.Sprintf("metric-%04d", i), Value: 1})
+		}
+		s.Apply("bar", events)
+		if n, _ := s.Namespace("bar"); n.Metrics != 2000 {
+			t.Error(n.Metrics)
+		}
+		seconds = 300 + 48*3600
+		s.Incr("bar", "fresh")
+		if expiry, err := s.Expire("bar", false); err != nil || len(expiry.Metrics) != 2000 {
+			t.Fatal(err)
+		}
+		if list, _ := s.Namespaces(); len(list) != 1 || list[0].Metrics != 1 {
+			t.Error(list)
+		}
+	})
+}
+
+func TestStoreMeta(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		s.Incr("foo", "latency")
+		s.PutDerived("foo", "double", "latency * 2")
+		if err := s.PutMeta("foo", "latency", &MetricMeta{Description: "Page load", Unit: "ms", Chart: "bar"}); err != nil {
+			t.Error(err)
+		}
+		if err := s.PutMeta("foo", "double", &MetricMeta{Hidden: true}); err != nil {
+			t.Error(err)
+		}
+		if err := s.PutMeta("foo", "latency", &MetricMeta{Chart: "pie"}); err != ErrMeta {
+			t.Error(err)
+		}
+		list, _ := s.List("foo")
+		if len(list) != 2 || !list[0].Hidden || list[1].Unit != "ms" || list[1].Description != "Page load" {
+			t.Error(list)
+		}
+		// Metadata can be set before there is data
+		s.PutMeta("foo", "signup", &MetricMeta{Unit: "users"})
+		if meta, _ := s.Meta("foo", "signup"); meta.Unit != "users" {
+			t.Error(meta)
+		}
+		s.PutMeta("foo", "signup", &MetricMeta{})
+		if meta, err := s.Meta("foo", "signup"); err != nil || *meta != (MetricMeta{}) {
+			t.Error(meta, err)
+		}
+		s.DeleteNamespace("foo")
+		if meta, _ := s.Meta("foo", "latency"); *meta != (MetricMeta{}) {
+			t.Error(meta)
+		}
+	})
+}
+
+func TestStoreImport(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seconds = 0
+		s.Incr("foo", "bar")
+		c := NewCounter(nil)
+		c.Incr()
+		c.Incr()
+		if err := s.Import("foo", map[string]*Counter{"bar": c, "baz": c}); err != nil {
+			t.Fatal(err)
+		}
+		if c, _ := s.Query("foo", "bar"); c.Values[BucketIndex("total")][0] != 3 {
+			t.Error(c.Values)
+		}
+		g := NewCounter(nil)
+		g.Kind = KindGauge
+		if err := s.Import("foo", map[string]*Counter{"bar": g}); err == nil {
+			t.Error("kind mismatch accepted")
+		}
+	})
+}
+
+func TestStoreBackup(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		s.Incr("foo", "bar")
+		buf := &bytes.Buffer{}
+		if n, err := s.Backup(buf); err != nil || n != int64(buf.Len()) || n == 0 {
+			t.Error(n, err)
+		}
+		// Snapshots of any store restore into a bolt database
+		path := tempPath(t, "restored.db")
+		if err := Restore(path, buf); err != nil {
+			t.Fatal(err)
+		}
+		restored, _ := NewStore(path)
+		defer restored.(*store).db.Close()
+		if c, err := restored.Query("foo", "bar"); err != nil || c.Values[BucketIndex("total")][0] != 1 {
+			t.Error(c, err)
+		}
+	})
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					s.Incr("foo", "bar")
+					s.Apply("foo", []Event{{Metric: "bar", Value: 1}})
+					s.Query("foo", "bar")
+				}
+			}()
+		}
+		wg.Wait()
+		if c, _ := s.Query("foo", "bar"); c.Values[BucketIndex("total")][0] != 400 {
+			t.Error(c.Values[BucketIndex("total")])
+		}
+	})
+}
+
+func TestStoreExpire(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seconds = 100
+		s.Incr("foo", "old")
+		s.Incr("foo", "flag")
+		s.PutMeta("foo", "old", &MetricMeta{Unit: "ms"})
+		s.Incr("bar", "old")
+		seconds = 100 + 3600
+		s.Incr("foo", "new")
+		seconds = 100 + 3600*2
+		s.Incr("foo", "flag")
+
+		// No retention, nothing expires
+		if e, err := s.Expire("foo", false); err != nil || len(e.Metrics) != 0 {
+			t.Error(e, err)
+		}
+		s.PutNamespace(&Namespace{Name: "foo", Retention: "90m"})
+		e, err := s.Expire("foo", true)
+		if err != nil || e.Retention != "90m" || e.Before == nil || e.Before.Unix() != 100+3600/2 {
+			t.Fatal(e, err)
+		}
+		if len(e.Metrics) != 1 || e.Metrics[0].Name != "old" || e.Metrics[0].Atime.Unix() != 100 {
+			t.Error(e.Metrics)
+		}
+		if list, _ := s.List("foo"); len(list) != 3 {
+			t.Error("dry run deleted metrics", list)
+		}
+
+		if e, err := s.Expire("foo", false); err != nil || len(e.Metrics) != 1 || e.Metrics[0].Name != "old" {
+			t.Error(e, err)
+		}
+		if list, _ := s.List("foo"); len(list) != 2 || list[0].Name != "flag" || list[1].Name != "new" {
+			t.Error(list)
+		}
+		if meta, _ := s.Meta("foo", "old"); meta.Unit != "" {
+			t.Error(meta)
+		}
+		if list, _ := s.List("bar"); len(list) != 1 {
+			t.Error(list)
+		}
+
+		seconds = 100 + 3600*4
+		if err := expireAll(s); err != nil {
+			t.Error(err)
+		}
+		if list, _ := s.List("foo"); len(list) != 0 {
+			t.Error(list)
+		}
+		if list, _ := s.List("bar"); len(list) != 1 {
+			t.Error(list)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindCounter Kind = "c"
+	KindGauge   Kind = "g"
+	KindTimer   Kind = "ms"
+	KindTopK    Kind = "topk"
+	KindDerived Kind = "d"
+)
+
+var ErrKind = errors.New("metric type mismatch")
+var ErrFuture = errors.New("timestamp is in the future")
+var ErrValue = errors.New("invalid value for metric type")
+var ErrDerived = errors.New("name of a derived metric")
+var ErrReserved = errors.New("reserved metric name")
+
+// ReservedNames are routes under /api/:ns, metrics can't be named like them.
+var ReservedNames = map[string]bool{"batch": true, "export": true}
+
+// Event is a single submitted metric value, as accepted by the batch API.
+// Top-K metrics take a string value, which is kept in Item.
+type Event struct {
+	Metric string            `json:"metric" binding:"required"`
+	Type   Kind              `json:"type" binding:"omitempty,eq=c|eq=g|eq=ms|eq=topk"`
+	Value  Value             `json:"value"`
+	Item   string            `json:"-"`
+	Ts     int64             `json:"ts" binding:"omitempty,gte=0"`
+	Labels map[string]string `json:"labels"`
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	type event Event
+	v := struct {
+		*event
+		Value json.RawMessage `json:"value"`
+	}{event: (*event)(e)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if len(v.Value) > 0 && v.Value[0] == '"' {
+		return json.Unmarshal(v.Value, &e.Item)
+	} else if len(v.Value) > 0 {
+		return json.Unmarshal(v.Value, &e.Value)
+	}
+	return nil
+}
+
+// ItemError tells which event of a batch caused the whole batch to fail.
+type ItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("item %d: %v", e.Index, e.Err)
+}
+
+func (e *Event) Kind() Kind {
+	if e.Type == "" {
+		return KindCounter
+	}
+	return e.Type
+}
+
+func (e *Event) Time() time.Time {
+	if e.Ts == 0 {
+		return Now()
+	}
+	return time.Unix(e.Ts, 0)
+}
+
+// Name returns the counter name of the event, labels are appended in sorted
+// order, e.g. "signup{plan=free,src=ads}".
+func (e *Event) Name() string {
+	if len(e.Labels) == 0 {
+		return e.Metric
+	}
+	labels := []string{}
+	for k, v := range e.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return e.Metric + "{" + strings.Join(labels, ",") + "}"
+}
+
+func (e *Event) Validate() error {
+	if ReservedNames[e.Name()] {
+		return ErrReserved
+	}
+	if e.Time().After(Now()) {
+		return ErrFuture
+	}
+	if (e.Kind() == KindTopK) != (e.Item != "") {
+		return ErrValue
+	}
+	// Counters are exact integers
+	if e.Kind() == KindCounter && e.Value != Value(math.Trunc(float64(e.Value))) {
+		return ErrValue
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExpiredMetric is a counter that got no updates for longer than the
+// retention of its namespace.
+type ExpiredMetric struct {
+	Name  string    `json:"name"`
+	Atime time.Time `json:"atime"`
+}
+
+// Expiry lists the expired counters of a namespace, the ones last updated
+// before Before. Before is nil if the namespace has no retention.
+type Expiry struct {
+	Retention string          `json:"retention"`
+	Before    *time.Time      `json:"before,omitempty"`
+	Metrics   []ExpiredMetric `json:"metrics"`
+}
+
+// Expire finds counters of the namespace older than its retention and
+// deletes them with their metadata unless dryRun is set. Namespaces without
+// retention keep their counters forever. Counters are deleted in small
+// transactions and checked again before deletion, so ones updated meanwhile
+// are kept.
+func (s *store) Expire(ns string, dryRun bool) (*Expiry, error) {
+	const batch = 1000
+	var n *Namespace
+	var before time.Time
+	expiry := &Expiry{Metrics: []ExpiredMetric{}}
+	if err := s.db.View(func(tx KVTx) (err error) {
+		if n, err = readNamespace(tx, ns); err != nil || n.Retention == "" {
+			return err
+		}
+		retention, err := time.ParseDuration(n.Retention)
+		if err != nil {
+			return err
+		}
+		before = Now().Add(-retention)
+		expiry.Retention, expiry.Before = n.Retention, &before
+		b := nsBucket(tx, IncrBucket, ns)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if atime, _, err := counterStat(v); err != nil {
+				return err
+			} else if atime.Before(before) {
+				expiry.Metrics = append(expiry.Metrics, ExpiredMetric{string(k), atime})
+			}
+		}
+		return nil
+	}); err != nil || dryRun {
+		return expiry, err
+	}
+	expired := expiry.Metrics
+	expiry.Metrics = []ExpiredMetric{}
+	for len(expired) > 0 {
+		i := batch
+		if i > len(expired) {
+			i = len(expired)
+		}
+		if err := s.db.Update(func(tx KVTx) error {
+			counters, meta := nsBucket(tx, IncrBucket, ns), nsBucket(tx, MetaBucket, ns)
+			if counters == nil {
+				// The namespace was deleted meanwhile
+				return nil
+			}
+			for _, m := range expired[:i] {
+				data := counters.Get([]byte(m.Name))
+				if data == nil {
+					continue
+				} else if atime, _, err := counterStat(data); err != nil {
+					return err
+				} else if !atime.Before(before) {
+					continue
+				}
+				if err := counters.Delete([]byte(m.Name)); err != nil {
+					return err
+				}
+				if meta != nil {
+					if err := meta.Delete([]byte(m.Name)); err != nil {
+						return err
+					}
+				}
+				expiry.Metrics = append(expiry.Metrics, m)
+			}
+			return nil
+		}); err != nil {
+			return expiry, err
+		}
+		expired = expired[i:]
+	}
+	return expiry, nil
+}
+
+// expireAll expires counters of every namespace with retention.
+func expireAll(s Store) error {
+	list, err := s.Namespaces()
+	if err != nil {
+		return err
+	}
+	for _, n := range list {
+		if n.Retention == "" {
+			continue
+		}
+		expiry, err := s.Expire(n.Name, false)
+		if err != nil {
+			return err
+		}
+		if len(expiry.Metrics) > 0 {
+			log.Printf("expired %d metrics of %s", len(expiry.Metrics), n.Name)
+		}
+	}
+	return nil
+}
+
+// runExpiry expires stale counters of all namespaces every interval.
+func runExpiry(s Store, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := expireAll(s); err != nil {
+			log.Println("expire:", err)
+		}
+	}
+}
+
+// expire reports expired counters of the namespace, or deletes them if the
+// request is not a GET.
+func expire(c *gin.Context, s Store) {
+	if expiry, err := s.Expire(c.Param("ns"), c.Request.Method == "GET"); err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.JSON(200, expiry)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportRow is a single slot of a counter with an absolute timestamp.
+type exportRow struct {
+	Metric string `json:"metric"`
+	Ts     int64  `json:"ts"`
+	Value  Value  `json:"value"`
+}
+
+type exportWriter interface {
+	Write(row exportRow) error
+	Flush() error
+}
+
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) Write(row exportRow) error {
+	return e.w.Write([]string{row.Metric, strconv.FormatInt(row.Ts, 10),
+		strconv.FormatFloat(float64(row.Value), 'f', -1, 64)})
+}
+
+func (e *csvExport) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExport struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExport) Write(row exportRow) error {
+	return e.enc.Encode(row)
+}
+
+func (e *ndjsonExport) Flush() error {
+	return nil
+}
+
+// flushExport pushes every flushed metric to the client right away.
+type flushExport struct {
+	exportWriter
+	http.Flusher
+}
+
+func (e flushExport) Flush() error {
+	if err := e.exportWriter.Flush(); err != nil {
+		return err
+	}
+	e.Flusher.Flush()
+	return nil
+}
+
+// Export streams every metric of the namespace, oldest slot first.
+func Export(s Store, ns string, bucket int, w exportWriter) error {
+	return s.Walk(ns, func(name string, c *Counter) error {
+		values := c.Values[bucket]
+		for slot := len(values) - 1; slot >= 0; slot-- {
+			row := exportRow{Metric: name, Ts: c.SlotTime(bucket, slot).Unix(), Value: values[slot]}
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	})
+}
+
+func export(c *gin.Context, s Store) {
+	bucket := BucketIndex(c.DefaultQuery("bucket", "day"))
+	if bucket < 0 {
+		c.AbortWithStatus(400)
+		return
+	}
+	var w exportWriter
+	switch c.DefaultQuery("format", "csv") {
+	case "csv":
+		c.Header("Content-Type", "text/csv")
+		cw := csv.NewWriter(c.Writer)
+		cw.Write([]string{"metric", "ts", "value"})
+		w = &csvExport{cw}
+	case "ndjson":
+		c.Header("Content-Type", "application/x-ndjson")
+		w = &ndjsonExport{json.NewEncoder(c.Writer)}
+	default:
+		c.AbortWithStatus(400)
+		return
+	}
+	c.Status(200)
+	if err := Export(s, c.Param("ns"), bucket, flushExport{w, c.Writer}); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestExport(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		defer func(n int) { WalkBatch = n }(WalkBatch)
+		WalkBatch = 1
+		seconds = 3600
+		s.Incr("foo", "bar")
+		s.Incr("foo", "baz")
+		e := gin.New()
+		e.GET("/api/:ns/:counter", func(c *gin.Context) {
+			if c.Param("counter") == "export" {
+				export(c, s)
+			} else {
+				query(c, s)
+			}
+		})
+		e.POST("/api/:ns/:counter", func(c *gin.Context) { incr(c, s, false) })
+
+		w := serve(e, "GET", "/api/foo/export?bucket=total", "", "", nil)
+		if w.Code != 200 || w.Body.String() != "metric,ts,value\nbar,3600,1\nbaz,3600,1\n" {
+			t.Error(w.Code, w.Body.String())
+		}
+		w = serve(e, "GET", "/api/foo/export?format=ndjson&bucket=day", "", "", nil)
+		if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 48 {
+			t.Error(lines)
+		}
+		if w := serve(e, "GET", "/api/foo/export?format=xml", "", "", nil); w.Code != 400 {
+			t.Error(w.Code)
+		}
+		// The name of the export is reserved
+		if w := serve(e, "POST", "/api/foo/export", "", "", nil); w.Code != 400 {
+			t.Error(w.Code)
+		}
+		if err := s.Apply("foo", []Event{{Metric: "export"}}); err == nil {
+			t.Error("counter named export")
+		}
+		if err := s.PutDerived("foo", "export", "bar + baz"); err != ErrReserved {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var ErrExpr = errors.New("invalid expression")
+
+// Expr is a derived metric expression evaluated slot by slot over counters,
+// e.g. "purchase / visit * 100" or "ma(rate(errors), 5)". Functions are the
+// Transforms with their arguments after the expression. Metric names with
+// characters other than letters, digits, '_' and '.' must be quoted.
+type Expr interface {
+	// Eval returns values of every bucket given the referenced counters.
+	Eval(counters map[string]*Counter) [][]Value
+	// Metrics appends the names of referenced counters.
+	Metrics(names []string) []string
+}
+
+type numExpr Value
+
+type metricExpr string
+
+type binExpr struct {
+	op   byte
+	l, r Expr
+}
+
+type callExpr struct {
+	fn   string
+	arg  Expr
+	args []Value
+}
+
+func (e numExpr) Eval(counters map[string]*Counter) [][]Value {
+	values := [][]Value{}
+	for _, bucket := range Buckets {
+		v := make([]Value, bucket.Size)
+		for i := range v {
+			v[i] = Value(e)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func (e numExpr) Metrics(names []string) []string {
+	return names
+}
+
+func (e metricExpr) Eval(counters map[string]*Counter) [][]Value {
+	if c, ok := counters[string(e)]; ok {
+		return c.Values
+	}
+	return numExpr(0).Eval(counters)
+}
+
+func (e metricExpr) Metrics(names []string) []string {
+	return append(names, string(e))
+}
+
+func (e *binExpr) Eval(counters map[string]*Counter) [][]Value {
+	l, r := e.l.Eval(counters), e.r.Eval(counters)
+	values := [][]Value{}
+	for i := range Buckets {
+		v := make([]Value, len(l[i]))
+		for j := range v {
+			switch e.op {
+			case '+':
+				v[j] = l[i][j] + r[i][j]
+			case '-':
+				v[j] = l[i][j] - r[i][j]
+			case '*':
+				v[j] = l[i][j] * r[i][j]
+			case '/':
+				// Empty slots are common, a ratio of nothing is zero
+				if r[i][j] != 0 {
+					v[j] = l[i][j] / r[i][j]
+				}
+			}
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func (e *binExpr) Metrics(names []string) []string {
+	return e.r.Metrics(e.l.Metrics(names))
+}
+
+func (e *callExpr) Eval(counters map[string]*Counter) [][]Value {
+	arg := e.arg.Eval(counters)
+	// Counters of a namespace are rolled to the same time and share the
+	// times of their slots
+	clock := NewCounter(nil)
+	for _, c := range counters {
+		clock = c
+		break
+	}
+	values := [][]Value{}
+	for i := range Buckets {
+		values = append(values, Transforms[e.fn].Fn(clock, i, arg[i], e.args))
+	}
+	return values
+}
+
+func (e *callExpr) Metrics(names []string) []string {
+	return e.arg.Metrics(names)
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func ParseExpr(s string) (Expr, error) {
+	p := &exprParser{s: s}
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.pos != len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return e, nil
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%v at %d: %s", ErrExpr, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) skip() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek skips spaces and returns the next character or 0 at the end.
+func (p *exprParser) peek() byte {
+	if p.skip(); p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) sum() (Expr, error) {
+	l, err := p.product()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.s[p.pos]
+		p.pos++
+		var r Expr
+		if r, err = p.product(); err == nil {
+			l = &binExpr{op, l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) product() (Expr, error) {
+	l, err := p.unary()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.s[p.pos]
+		p.pos++
+		var r Expr
+		if r, err = p.unary(); err == nil {
+			l = &binExpr{op, l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) unary() (Expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		e, err := p.unary()
+		return &binExpr{'-', numExpr(0), e}, err
+	}
+	return p.primary()
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '.' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+func (p *exprParser) primary() (Expr, error) {
+	switch c := p.peek(); {
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return e, nil
+	case c == '"':
+		end := strings.IndexByte(p.s[p.pos+1:], '"')
+		if end < 0 {
+			return nil, p.errorf("unterminated name")
+		}
+		name := p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return metricExpr(name), nil
+	case c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] == '.' || (p.s[p.pos] >= '0' && p.s[p.pos] <= '9')) {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("bad number %q", p.s[start:p.pos])
+		}
+		return numExpr(v), nil
+	case c != 0 && isNameChar(c):
+		start := p.pos
+		for p.pos < len(p.s) && isNameChar(p.s[p.pos]) {
+			p.pos++
+		}
+		// Labels are part of the metric name, e.g. signup{plan=free}
+		if p.pos < len(p.s) && p.s[p.pos] == '{' {
+			end := strings.IndexByte(p.s[p.pos:], '}')
+			if end < 0 {
+				return nil, p.errorf("unterminated labels")
+			}
+			p.pos += end + 1
+		}
+		name := p.s[start:p.pos]
+		if p.peek() == '(' {
+			return p.call(name)
+		}
+		return metricExpr(name), nil
+	case c == 0:
+		return nil, p.errorf("unexpected end")
+	default:
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+func (p *exprParser) call(fn string) (Expr, error) {
+	t, ok := Transforms[fn]
+	if !ok {
+		return nil, p.errorf("unknown function %s", fn)
+	}
+	p.pos++
+	arg, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	e := &callExpr{fn: fn, arg: arg}
+	for i := 0; i < t.Args; i++ {
+		if p.peek() != ',' {
+			return nil, p.errorf("%s takes %d arguments", fn, t.Args+1)
+		}
+		p.pos++
+		n, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		v, ok := n.(numExpr)
+		if !ok || v < 1 {
+			return nil, p.errorf("%s argument must be a positive number", fn)
+		}
+		e.args = append(e.args, Value(v))
+	}
+	if p.peek() != ')' {
+		return nil, p.errorf("expected )")
+	}
+	p.pos++
+	return e, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	for _, s := range []string{
+		"purchase / visit", "(a + b) * 2 - -c", "ma(rate(errors), 5)",
+		`"my-metric" / signup{plan=free}`, "1.5",
+	} {
+		if _, err := ParseExpr(s); err != nil {
+			t.Error(s, err)
+		}
+	}
+	for _, s := range []string{
+		"", "a +", "(a", "a b", "foo(a)", "ma(a)", "ma(a, b)", "ma(a, 0)", "rate(a, 1)", `"a`, "a{b", "a % b",
+	} {
+		if _, err := ParseExpr(s); err == nil {
+			t.Error(s)
+		}
+	}
+	e, _ := ParseExpr("a / b + a * 2")
+	if names := e.Metrics(nil); len(names) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "a" {
+		t.Error(names)
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	a, b := NewCounter(nil), NewCounter(nil)
+	day := BucketIndex("day")
+	a.Values[day][0], a.Values[day][1], a.Values[day][2] = 1, 3, 8
+	b.Values[day][0], b.Values[day][1] = 4, 6
+	counters := map[string]*Counter{"a": a, "b": b}
+
+	e, _ := ParseExpr("a / b * 100")
+	if v := e.Eval(counters)[day]; v[0] != 25 || v[1] != 50 || v[2] != 0 {
+		t.Error(v)
+	}
+	e, _ = ParseExpr("ma(a, 2)")
+	if v := e.Eval(counters)[day]; v[0] != 2 || v[1] != 5.5 || v[2] != 4 {
+		t.Error(v)
+	}
+	e, _ = ParseExpr("rate(a + missing)")
+	if v := e.Eval(counters)[day]; v[2] != Value(8)/3600 {
+		t.Error(v)
+	}
+}
+
+func TestStoreDerived(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+	s.Apply("foo", []Event{{Metric: "visit", Value: 4}, {Metric: "purchase", Value: 1}})
+
+	if err := s.PutDerived("foo", "conversion", "purchase / visit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutDerived("foo", "visit", "purchase"); err != ErrExists {
+		t.Error(err)
+	}
+	if err := s.PutDerived("foo", "broken", "purchase /"); err == nil {
+		t.Error("invalid expression saved")
+	}
+	if list, _ := s.List("foo"); len(list) != 3 ||
+		list[0] != (Metric{Name: "conversion", Derived: true}) ||
+		list[1] != (Metric{Name: "purchase"}) || list[2] != (Metric{Name: "visit"}) {
+		t.Error(list)
+	}
+	if c, err := s.Query("foo", "conversion"); err != nil {
+		t.Error(err)
+	} else if c.Kind != KindDerived || c.Values[BucketIndex("total")][0] != 0.25 {
+		t.Error(c.Kind, c.Values[BucketIndex("total")])
+	}
+	if err := s.DeleteDerived("foo", "conversion"); err != nil {
+		t.Error(err)
+	} else if _, err := s.Query("foo", "conversion"); err != ErrNotFound {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// histogramGamma is the ratio of adjacent histogram bins, quantiles are
+// within 1% of the true value.
+const histogramGamma = 1.02
+
+// histogramZero is the bin of zero and negative values.
+const histogramZero = math.MinInt32
+
+// Histogram is a mergeable sketch of a distribution, e.g. of timings. Values
+// are counted in logarithmic bins, so merging histograms is adding their bins.
+type Histogram struct {
+	Bins map[int32]uint64
+	Max  Value
+}
+
+func histogramBin(v Value) int32 {
+	if v <= 0 {
+		return histogramZero
+	}
+	return int32(math.Floor(math.Log(float64(v)) / math.Log(histogramGamma)))
+}
+
+func (h *Histogram) Add(v Value) {
+	if h.Bins == nil {
+		h.Bins = map[int32]uint64{}
+	}
+	h.Bins[histogramBin(v)]++
+	if v > h.Max {
+		h.Max = v
+	}
+}
+
+func (h *Histogram) Merge(o Histogram) {
+	if h.Bins == nil && len(o.Bins) > 0 {
+		h.Bins = map[int32]uint64{}
+	}
+	for bin, n := range o.Bins {
+		h.Bins[bin] += n
+	}
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+}
+
+func (h *Histogram) Count() (n uint64) {
+	for _, c := range h.Bins {
+		n += c
+	}
+	return n
+}
+
+// Quantile returns the q-quantile (0 < q <= 1) of the values, or zero if
+// there are none.
+func (h *Histogram) Quantile(q float64) Value {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(count)))
+	if rank >= count {
+		return h.Max
+	}
+	bins := make([]int, 0, len(h.Bins))
+	for bin := range h.Bins {
+		bins = append(bins, int(bin))
+	}
+	sort.Ints(bins)
+	seen := uint64(0)
+	for _, bin := range bins {
+		if seen += h.Bins[int32(bin)]; seen >= rank {
+			if bin == histogramZero {
+				return 0
+			}
+			// Middle of the bin, but never above the largest value seen
+			v := Value(math.Pow(histogramGamma, float64(bin)+0.5))
+			if v > h.Max {
+				v = h.Max
+			}
+			return v
+		}
+	}
+	return h.Max
+}
+
+// Percentiles are the quantiles reported for timers.
+var Percentiles = []struct {
+	Name string
+	Q    float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+	{"max", 1},
+}
+
+// Percentiles returns the reported quantiles of every slot of the bucket.
+func (c *Counter) Percentiles(i int) map[string][]Value {
+	p := map[string][]Value{}
+	for _, pc := range Percentiles {
+		values := make([]Value, Buckets[i].Size)
+		if c.Hists != nil {
+			for slot := range values {
+				values[slot] = c.Hists[i][slot].Quantile(pc.Q)
+			}
+		}
+		p[pc.Name] = values
+	}
+	return p
+}
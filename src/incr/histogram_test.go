@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := Histogram{}
+	for i := 1; i <= 1000; i++ {
+		h.Add(Value(i))
+	}
+	for q, want := range map[float64]float64{0.5: 500, 0.9: 900, 0.99: 990, 1: 1000} {
+		if v := float64(h.Quantile(q)); math.Abs(v-want)/want > 0.01 {
+			t.Error(q, v)
+		}
+	}
+	if h.Count() != 1000 || h.Max != 1000 {
+		t.Error(h.Count(), h.Max)
+	}
+
+	// Merging is the same as adding all values to one histogram
+	a, b := Histogram{}, Histogram{}
+	for i := 1; i <= 1000; i++ {
+		if i%2 == 0 {
+			a.Add(Value(i))
+		} else {
+			b.Add(Value(i))
+		}
+	}
+	a.Merge(b)
+	if a.Count() != h.Count() || a.Max != h.Max || a.Quantile(0.9) != h.Quantile(0.9) {
+		t.Error(a)
+	}
+
+	empty := Histogram{}
+	empty.Add(0)
+	if (&Histogram{}).Quantile(0.5) != 0 || empty.Quantile(0.5) != 0 {
+		t.Error(empty)
+	}
+}
+
+func TestStoreTimer(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+
+	seconds = 0
+	s.Apply("foo", []Event{{Metric: "req", Type: KindTimer, Value: 10}, {Metric: "req", Type: KindTimer, Value: 100}})
+	seconds = 5
+	s.Apply("foo", []Event{{Metric: "req", Type: KindTimer, Value: 20}})
+
+	c, err := s.Query("foo", "req")
+	if err != nil {
+		t.Fatal(err)
+	}
+	realtime := c.Percentiles(BucketIndex("realtime"))
+	if c.Values[BucketIndex("realtime")][0] != 1 || c.Values[BucketIndex("realtime")][5] != 2 {
+		t.Error(c.Values[BucketIndex("realtime")])
+	} else if realtime["max"][0] != 20 || realtime["max"][5] != 100 || realtime["max"][1] != 0 {
+		t.Error(realtime)
+	}
+	if total := c.Percentiles(BucketIndex("total")); total["max"][0] != 100 ||
+		math.Abs(float64(total["p50"][0])-20) > 0.2 {
+		t.Error(total)
+	}
+
+	// Histograms survive archiving and merge on import
+	b := &bytes.Buffer{}
+	WriteArchive(s, "foo", b)
+	counters, err := ReadArchive(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Import("foo", counters)
+	c, _ = s.Query("foo", "req")
+	if h := c.Hists[BucketIndex("total")][0]; h.Count() != 6 || h.Max != 100 {
+		t.Error(h)
+	}
+}
@@ -6,8 +6,13 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
+
+	"incr/pb"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/golang/protobuf/proto"
 )
 
 var DBPath = "incr.db"
@@ -35,51 +40,343 @@ func corsHandler(c *gin.Context) {
 }
 
 func incr(c *gin.Context, s Store, gif bool) {
-	s.Incr(c.Param("ns"), strings.TrimSuffix(c.Param("counter"), ".gif"))
-	if gif {
+	err := s.Incr(c.Param("ns"), strings.TrimSuffix(c.Param("counter"), ".gif"))
+	if e, ok := err.(*ItemError); ok {
+		err = e.Err
+	}
+	if err == ErrDerived {
+		c.String(409, err.Error())
+	} else if err == ErrReserved {
+		c.String(400, err.Error())
+	} else if gif {
 		c.Data(200, "image/gif", minimalGIF)
 	} else {
 		c.AbortWithStatus(200)
 	}
 }
 
+// query returns the timeline of a metric, optionally transformed.
+func query(c *gin.Context, s Store) {
+	transform := func(*Counter) {}
+	if t := c.Query("transform"); t != "" {
+		var err error
+		if transform, err = ParseTransforms(t); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+	}
+	counter, err := s.Query(c.Param("ns"), c.Param("counter"))
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatus(500)
+		return
+	}
+	transform(counter)
+	result := gin.H{"now": counter.Atime}
+	for i, bucket := range Buckets {
+		result[bucket.Name] = counter.Values[i]
+	}
+	if counter.Kind == KindTimer {
+		percentiles := gin.H{}
+		for i, bucket := range Buckets {
+			percentiles[bucket.Name] = counter.Percentiles(i)
+		}
+		result["percentiles"] = percentiles
+	} else if counter.Kind == KindTopK {
+		top := gin.H{}
+		for i, bucket := range Buckets {
+			top[bucket.Name] = counter.Top(i)
+		}
+		result["top"] = top
+	}
+	respond(c, 200, result, func() proto.Message { return counterToProto(counter) })
+}
+
+func batch(c *gin.Context, s Store) {
+	events := []Event{}
+	if c.ContentType() == binding.MIMEPROTOBUF {
+		msg := &pb.Batch{}
+		if c.BindWith(msg, binding.ProtoBuf) != nil {
+			return
+		}
+		events = eventsFromProto(msg)
+	} else if c.BindJSON(&events) != nil {
+		return
+	}
+	results := make([]gin.H, len(events))
+	failed := false
+	for i := range events {
+		if err := binding.Validator.ValidateStruct(&events[i]); err != nil {
+			results[i] = gin.H{"status": "error", "error": err.Error()}
+			failed = true
+		} else if err := events[i].Validate(); err != nil {
+			results[i] = gin.H{"status": "error", "error": err.Error()}
+			failed = true
+		} else {
+			results[i] = gin.H{"status": "ok"}
+		}
+	}
+	if !failed {
+		if err := s.Apply(c.Param("ns"), events); err != nil {
+			if e, ok := err.(*ItemError); ok {
+				results[e.Index] = gin.H{"status": "error", "error": e.Err.Error()}
+				failed = true
+			} else {
+				log.Println(err)
+				c.AbortWithStatus(500)
+				return
+			}
+		}
+	}
+	if failed {
+		// Nothing is applied if a single item is invalid
+		for i := range results {
+			if results[i]["status"] == "ok" {
+				results[i] = gin.H{"status": "skipped"}
+			}
+		}
+		respond(c, 400, results, func() proto.Message { return resultsToProto(results) })
+	} else {
+		respond(c, 200, results, func() proto.Message { return resultsToProto(results) })
+	}
+}
+
+// adminHandler guards admin routes with the bearer token of INCRADMINTOKEN.
+// Admin routes are disabled if the token is not set.
+func adminHandler(c *gin.Context) {
+	if os.Getenv("INCRADMINTOKEN") == "" {
+		c.AbortWithStatus(403)
+	} else if !isAdmin(c) {
+		c.AbortWithStatus(401)
+	} else {
+		c.Next()
+	}
+}
+
+// isAdmin reports if the request has the admin token.
+func isAdmin(c *gin.Context) bool {
+	token := os.Getenv("INCRADMINTOKEN")
+	return token != "" && c.Request.Header.Get("Authorization") == "Bearer "+token
+}
+
 func main() {
 	if db := os.Getenv("INCRDB"); db != "" {
 		DBPath = db
 	}
+	if os.Getenv("INCRALIGN") == "round" {
+		Alignment = AlignRound
+	}
+
+	if len(os.Args) == 3 && os.Args[1] == "restore" {
+		f, err := os.Open(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		// Snapshots are bolt files, other backends can't be restored into
+		scheme, path := ParseDSN(DBPath)
+		if scheme != "bolt" {
+			log.Fatalf("can't restore into %s database", scheme)
+		}
+		if err := Restore(path, f); err != nil {
+			log.Fatal(err)
+		}
+		return
+	} else if len(os.Args) > 1 {
+		log.Fatalf("usage: %s [restore <snapshot.db>]", os.Args[0])
+	}
 
-	s, err := NewStore(DBPath)
+	db, err := OpenBackend(DBPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	replica, err := NewReplica(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	replica.Token = os.Getenv("INCRADMINTOKEN")
+	// INCRWAL logs events to a write-ahead log and commits them in groups
+	var s Store
+	if wal := os.Getenv("INCRWAL"); wal != "" {
+		s, err = NewWALStore(wal, replica)
+	} else {
+		s, err = NewStoreOn(replica)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if leader := os.Getenv("INCRLEADER"); leader != "" {
+		replica.Follow(strings.TrimSuffix(leader, "/"))
+	}
+
+	// INCRPEERS lists all nodes of a cluster, INCRSELF is the URL of this one
+	ring := NewRing("", nil)
+	if peers := os.Getenv("INCRPEERS"); peers != "" {
+		self := strings.TrimSuffix(os.Getenv("INCRSELF"), "/")
+		nodes := ParsePeers(peers)
+		found := false
+		for _, node := range nodes {
+			found = found || node == self
+		}
+		if !found {
+			log.Fatalf("INCRSELF %q is not in INCRPEERS", self)
+		}
+		ring = NewRing(self, nodes)
+	}
+
+	scheduleSnapshots(s)
+
+	alertInterval := time.Minute
+	if v := os.Getenv("INCRALERTINTERVAL"); v != "" {
+		if alertInterval, err = time.ParseDuration(v); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if v := os.Getenv("INCRWEBHOOKS"); v != "" {
+		WebhookPrefixes = strings.Split(v, ",")
+	}
+	alerter := NewAlerter(s)
+	if url := os.Getenv("INCRALERTMANAGER"); url != "" {
+		resend := time.Minute
+		if v := os.Getenv("INCRALERTMANAGERRESEND"); v != "" {
+			if resend, err = time.ParseDuration(v); err != nil {
+				log.Fatal(err)
+			}
+		}
+		alerter.Alertmanager = NewAlertmanager(url, resend)
+	}
+	expireInterval := time.Hour
+	if v := os.Getenv("INCREXPIREINTERVAL"); v != "" {
+		if expireInterval, err = time.ParseDuration(v); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if replica.Following() {
+		// Alert state is only kept by the leader, expired metrics are
+		// deleted by it too
+		go func() {
+			<-replica.Promoted()
+			go runExpiry(s, expireInterval)
+			alerter.Run(alertInterval)
+		}()
+	} else {
+		go runExpiry(s, expireInterval)
+		go alerter.Run(alertInterval)
+	}
 
 	r := gin.Default()
-	r.Use(corsHandler)
+	r.Use(corsHandler, clusterHandler(ring), readOnlyHandler(replica))
+	admin := r.Group("/admin", adminHandler)
+	admin.GET("/replication", func(c *gin.Context) {
+		c.JSON(200, replica.Status())
+	})
+	admin.GET("/replication/stream", func(c *gin.Context) {
+		stream(c, replica)
+	})
+	admin.POST("/replication/promote", func(c *gin.Context) {
+		replica.Promote()
+		c.JSON(200, replica.Status())
+	})
+	admin.GET("/backup", func(c *gin.Context) {
+		backup(c, s)
+	})
+	admin.GET("/namespaces", func(c *gin.Context) {
+		listNamespaces(c, s)
+	})
+	admin.POST("/namespaces", func(c *gin.Context) {
+		createNamespace(c, s)
+	})
+	admin.GET("/namespaces/:ns", func(c *gin.Context) {
+		getNamespace(c, s, c.Param("ns"), 200)
+	})
+	admin.PUT("/namespaces/:ns", func(c *gin.Context) {
+		putNamespace(c, s)
+	})
+	admin.DELETE("/namespaces/:ns", func(c *gin.Context) {
+		deleteNamespace(c, s)
+	})
+	admin.GET("/namespaces/:ns/expired", func(c *gin.Context) {
+		expire(c, s)
+	})
+	admin.DELETE("/namespaces/:ns/expired", func(c *gin.Context) {
+		expire(c, s)
+	})
+	admin.GET("/namespaces/:ns/archive", func(c *gin.Context) {
+		exportArchive(c, s)
+	})
+	admin.POST("/namespaces/:ns/archive", func(c *gin.Context) {
+		importArchive(c, s)
+	})
 	r.GET("/api/:ns", func(c *gin.Context) {
-		if list, err := s.List(c.Param("ns")); err != nil {
-			c.AbortWithStatus(500)
-		} else {
-			c.JSON(200, list)
-		}
+		listMetrics(c, s)
 	})
 	r.GET("/api/:ns/:counter", func(c *gin.Context) {
 		if strings.HasSuffix(c.Param("counter"), ".gif") {
 			incr(c, s, true)
+		} else if c.Param("counter") == "export" {
+			export(c, s)
 		} else {
-			if counter, err := s.Query(c.Param("ns"), c.Param("counter")); err != nil {
-				log.Println(err)
-				c.AbortWithStatus(500)
-			} else {
-				result := gin.H{"now": counter.Atime}
-				for i, bucket := range Buckets {
-					result[bucket.Name] = counter.Values[i]
-				}
-				c.JSON(200, result)
-			}
+			query(c, s)
 		}
 	})
+	r.GET("/api/:ns/:counter/meta", func(c *gin.Context) {
+		getMeta(c, s)
+	})
+	r.PUT("/api/:ns/:counter/meta", func(c *gin.Context) {
+		putMeta(c, s)
+	})
 	r.POST("/api/:ns/:counter", func(c *gin.Context) {
-		incr(c, s, false)
+		if c.Param("counter") == "batch" {
+			batch(c, s)
+		} else {
+			incr(c, s, false)
+		}
+	})
+	r.GET("/alerts/:ns", func(c *gin.Context) {
+		listRules(c, s)
+	})
+	r.POST("/alerts/:ns", func(c *gin.Context) {
+		createRule(c, s)
+	})
+	r.DELETE("/alerts/:ns/:id", func(c *gin.Context) {
+		deleteRule(c, s)
+	})
+	r.GET("/anomalies/:ns", func(c *gin.Context) {
+		anomalies(c, s)
+	})
+	r.GET("/anomalies/:ns/:counter", func(c *gin.Context) {
+		anomaly(c, s)
+	})
+	r.GET("/derived/:ns", func(c *gin.Context) {
+		if derived, err := s.Derived(c.Param("ns")); err != nil {
+			c.AbortWithError(500, err)
+		} else {
+			c.JSON(200, derived)
+		}
+	})
+	r.PUT("/derived/:ns/:name", func(c *gin.Context) {
+		var body struct {
+			Expr string `json:"expr" binding:"required"`
+		}
+		if c.BindJSON(&body) != nil {
+			return
+		}
+		if err := s.PutDerived(c.Param("ns"), c.Param("name"), body.Expr); err == ErrExists {
+			c.AbortWithError(409, err)
+		} else if err != nil {
+			c.String(400, err.Error())
+		} else {
+			c.AbortWithStatus(200)
+		}
+	})
+	r.DELETE("/derived/:ns/:name", func(c *gin.Context) {
+		if err := s.DeleteDerived(c.Param("ns"), c.Param("name")); err == ErrNotFound {
+			c.AbortWithStatus(404)
+		} else if err != nil {
+			c.AbortWithError(500, err)
+		} else {
+			c.AbortWithStatus(200)
+		}
 	})
 	r.NoRoute(func(c *gin.Context) {
 		log.Println(c.Request.URL.Path)
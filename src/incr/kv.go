@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// Backend is an embedded transactional key-value engine the store keeps its
+// records in. Records are grouped in buckets of sorted keys, the way bolt
+// does it, so that counter logic is shared by all engines.
+type Backend interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(tx KVTx) error) error
+	// Update runs fn in a read-write transaction, nothing is changed if fn
+	// returns an error.
+	Update(fn func(tx KVTx) error) error
+	// Backup writes a consistent snapshot of all buckets as a bolt database.
+	Backup(w io.Writer) (int64, error)
+	Close() error
+}
+
+type KVTx interface {
+	// Bucket returns nil if there is no such bucket.
+	Bucket(name []byte) KVBucket
+	CreateBucketIfNotExists(name []byte) (KVBucket, error)
+	DeleteBucket(name []byte) error
+	// ForEach calls fn for every bucket in name order.
+	ForEach(fn func(name []byte, b KVBucket) error) error
+}
+
+// KVBucket is a set of records sorted by key. Values returned by Get and
+// cursors are only valid within the transaction. Buckets can be nested, a
+// nested bucket shares the key space with records and has a nil value.
+type KVBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Cursor() KVCursor
+	NextSequence() (uint64, error)
+	// KeyN returns the number of records and nested buckets without reading
+	// them. It may not count changes of the current write transaction.
+	KeyN() int
+	// Bucket returns nil if there is no such nested bucket.
+	Bucket(name []byte) KVBucket
+	CreateBucketIfNotExists(name []byte) (KVBucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// KVCursor iterates records of a bucket in key order. A nil key means there
+// are no more records, a nil value means the key is a nested bucket.
+type KVCursor interface {
+	First() (key, value []byte)
+	Seek(seek []byte) (key, value []byte)
+	Next() (key, value []byte)
+}
+
+var ErrBackend = errors.New("unknown storage backend")
+
+// Backends open storage engines by the scheme of the INCRDB DSN. Other
+// engines, e.g. an LSM tree or SQLite, only need to implement Backend and
+// register here.
+var Backends = map[string]func(path string) (Backend, error){
+	"bolt": OpenBolt,
+	"log":  OpenLog,
+	"mem":  OpenMem,
+}
+
+// ParseDSN splits a DSN like "bolt:///var/lib/incr.db" into the backend
+// scheme and path. A plain path is a bolt file, ":memory:" is the in-memory
+// backend.
+func ParseDSN(dsn string) (scheme, path string) {
+	if dsn == ":memory:" {
+		return "mem", ""
+	} else if i := strings.Index(dsn, "://"); i >= 0 {
+		return dsn[:i], dsn[i+3:]
+	}
+	return "bolt", dsn
+}
+
+// OpenBackend opens the storage engine described by the DSN.
+func OpenBackend(dsn string) (Backend, error) {
+	scheme, path := ParseDSN(dsn)
+	if open, ok := Backends[scheme]; ok {
+		return open(path)
+	}
+	return nil, ErrBackend
+}
+
+// Open opens the store described by the DSN.
+func Open(dsn string) (Store, error) {
+	db, err := OpenBackend(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return NewStoreOn(db)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func forEachBackend(t *testing.T, fn func(t *testing.T, db Backend)) {
+	for _, name := range []string{"bolt", "log", "mem"} {
+		t.Run(name, func(t *testing.T) {
+			db, err := Backends[name](tempPath(t, "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			fn(t, db)
+		})
+	}
+}
+
+func TestParseDSN(t *testing.T) {
+	for dsn, want := range map[string][2]string{
+		"incr.db":                   {"bolt", "incr.db"},
+		"bolt:///var/lib/incr.db":   {"bolt", "/var/lib/incr.db"},
+		"bolt://incr.db":            {"bolt", "incr.db"},
+		"mem://":                    {"mem", ""},
+		":memory:":                  {"mem", ""},
+		"sqlite:///tmp/incr.sqlite": {"sqlite", "/tmp/incr.sqlite"},
+	} {
+		if scheme, path := ParseDSN(dsn); scheme != want[0] || path != want[1] {
+			t.Error(dsn, scheme, path)
+		}
+	}
+	if _, err := Open("sqlite:///tmp/incr.sqlite"); err != ErrBackend {
+		t.Error(err)
+	}
+}
+
+func TestBackendRollback(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		db.Update(func(tx KVTx) error {
+			b, _ := tx.CreateBucketIfNotExists([]byte("foo"))
+			b.Put([]byte("a"), []byte("1"))
+			b.Put([]byte("b"), []byte("2"))
+			return nil
+		})
+		failed := errors.New("failed")
+		if err := db.Update(func(tx KVTx) error {
+			b := tx.Bucket([]byte("foo"))
+			b.Put([]byte("a"), []byte("3"))
+			b.Put([]byte("c"), []byte("4"))
+			b.Delete([]byte("b"))
+			b.NextSequence()
+			tx.CreateBucketIfNotExists([]byte("bar"))
+			return failed
+		}); err != failed {
+			t.Error(err)
+		}
+		db.View(func(tx KVTx) error {
+			if tx.Bucket([]byte("bar")) != nil {
+				t.Error("bucket not rolled back")
+			}
+			b := tx.Bucket([]byte("foo"))
+			if string(b.Get([]byte("a"))) != "1" || string(b.Get([]byte("b"))) != "2" || b.Get([]byte("c")) != nil {
+				t.Error("records not rolled back")
+			}
+			if err := b.Put([]byte("d"), nil); err == nil {
+				t.Error("read-only transaction written")
+			}
+			return nil
+		})
+		db.Update(func(tx KVTx) error {
+			if seq, _ := tx.Bucket([]byte("foo")).NextSequence(); seq != 1 {
+				t.Error(seq)
+			}
+			return nil
+		})
+	})
+}
+
+func TestBackendCursor(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		db.Update(func(tx KVTx) error {
+			b, _ := tx.CreateBucketIfNotExists([]byte("foo"))
+			for _, k := range []string{"c", "a", "e", "b", "d"} {
+				b.Put([]byte(k), []byte(k+k))
+			}
+			b.Delete([]byte("b"))
+			b.Delete([]byte("c"))
+			return nil
+		})
+		db.View(func(tx KVTx) error {
+			keys := ""
+			c := tx.Bucket([]byte("foo")).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				keys = keys + string(v)
+			}
+			if keys != "aaddee" {
+				t.Error(keys)
+			}
+			if k, _ := c.Seek([]byte("f")); k != nil {
+				t.Error(string(k))
+			}
+			return nil
+		})
+	})
+}
+
+func TestBackendNested(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db Backend) {
+		db.Update(func(tx KVTx) error {
+			b, _ := tx.CreateBucketIfNotExists([]byte("foo"))
+			b.Put([]byte("a"), []byte("1"))
+			nested, _ := b.CreateBucketIfNotExists([]byte("b"))
+			nested.Put([]byte("c"), []byte("2"))
+			if _, err := b.CreateBucketIfNotExists([]byte("a")); err == nil {
+				t.Error("record replaced by a bucket")
+			}
+			if err := b.Put([]byte("b"), []byte("3")); err == nil {
+				t.Error("bucket replaced by a record")
+			}
+			return nil
+		})
+		failed := errors.New("failed")
+		db.Update(func(tx KVTx) error {
+			b := tx.Bucket([]byte("foo"))
+			b.DeleteBucket([]byte("b"))
+			b.CreateBucketIfNotExists([]byte("d"))
+			return failed
+		})
+		db.View(func(tx KVTx) error {
+			b := tx.Bucket([]byte("foo"))
+			keys := ""
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				keys = keys + string(k) + string(v) + ","
+			}
+			if keys != "a1,b," {
+				t.Error(keys)
+			}
+			if b.Get([]byte("b")) != nil || b.Bucket([]byte("a")) != nil {
+				t.Error("records and buckets mixed up")
+			}
+			if v := b.Bucket([]byte("b")).Get([]byte("c")); string(v) != "2" {
+				t.Error(v)
+			}
+			return nil
+		})
+		db.Update(func(tx KVTx) error {
+			return tx.Bucket([]byte("foo")).DeleteBucket([]byte("b"))
+		})
+		db.View(func(tx KVTx) error {
+			if tx.Bucket([]byte("foo")).Bucket([]byte("b")) != nil {
+				t.Error("bucket not deleted")
+			}
+			return nil
+		})
+	})
+}
+
+func TestLogBackendReopen(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	db, err := OpenLog(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx KVTx) error {
+		b, _ := tx.CreateBucketIfNotExists([]byte("foo"))
+		b.Put([]byte("a"), []byte("1"))
+		b.Put([]byte("b"), []byte("2"))
+		b.NextSequence()
+		nested, _ := b.CreateBucketIfNotExists([]byte("c"))
+		nested.Put([]byte("d"), []byte("3"))
+		return nil
+	})
+	db.Update(func(tx KVTx) error {
+		b := tx.Bucket([]byte("foo"))
+		b.Delete([]byte("a"))
+		b.NextSequence()
+		return nil
+	})
+	db.Update(func(tx KVTx) error {
+		tx.Bucket([]byte("foo")).Put([]byte("e"), []byte("4"))
+		return errors.New("failed")
+	})
+	db.Close()
+
+	// A torn transaction at the end is dropped
+	f, _ := os.OpenFile(dbPath, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	check := func(db Backend) {
+		db.Update(func(tx KVTx) error {
+			b := tx.Bucket([]byte("foo"))
+			if b.Get([]byte("a")) != nil || string(b.Get([]byte("b"))) != "2" || b.Get([]byte("e")) != nil {
+				t.Error("records not restored")
+			}
+			if nested := b.Bucket([]byte("c")); nested == nil || string(nested.Get([]byte("d"))) != "3" {
+				t.Error("nested bucket not restored")
+			}
+			if seq, _ := b.NextSequence(); seq != 3 {
+				t.Error(seq)
+			}
+			return errors.New("rollback")
+		})
+	}
+	if db, err = OpenLog(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	db.Close()
+	// Compacted on open, the log replays the same records
+	if db, err = OpenLog(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestLogBackendCompact(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	defer func(size int64) { LogCompactSize = size }(LogCompactSize)
+	LogCompactSize = 1024
+	db, err := OpenLog(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Update(func(tx KVTx) error {
+			b, _ := tx.CreateBucketIfNotExists([]byte("foo"))
+			return b.Put([]byte("a"), []byte(strconv.Itoa(i)))
+		})
+	}
+	db.Close()
+	if fi, _ := os.Stat(dbPath); fi.Size() > 2048 {
+		t.Error("log not compacted", fi.Size())
+	}
+	db, _ = OpenLog(dbPath)
+	defer db.Close()
+	db.View(func(tx KVTx) error {
+		if v := tx.Bucket([]byte("foo")).Get([]byte("a")); string(v) != "999" {
+			t.Error(string(v))
+		}
+		return nil
+	})
+}
+
+func TestLogBackendCorrupt(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	defer func(size int) { LogRecordSize = size }(LogRecordSize)
+	LogRecordSize = 1
+	db, err := OpenLog(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		db.Update(func(tx KVTx) error {
+			b, _ := tx.CreateBucketIfNotExists([]byte("foo"))
+			return b.Put([]byte(strconv.Itoa(i)), []byte("x"))
+		})
+	}
+	db.Close()
+
+	// Compacted into a record per operation, all of them are replayed
+	db, err = OpenLog(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx KVTx) error {
+		if n := tx.Bucket([]byte("foo")).KeyN(); n != 3 {
+			t.Error(n)
+		}
+		return nil
+	})
+	db.Close()
+
+	// A corrupt record in the middle is not mistaken for a torn one
+	data, _ := ioutil.ReadFile(dbPath)
+	second := 8 + binary.BigEndian.Uint32(data)
+	data[second+8+1] ^= 0xff
+	ioutil.WriteFile(dbPath, data, 0600)
+	if _, err := OpenLog(dbPath); err == nil {
+		t.Error("corrupt log opened")
+	}
+	if after, _ := ioutil.ReadFile(dbPath); !bytes.Equal(after, data) {
+		t.Error("corrupt log modified")
+	}
+}
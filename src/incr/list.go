@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+)
+
+var ErrCursor = errors.New("invalid cursor")
+var ErrSort = errors.New("invalid sort order")
+
+// ListQuery selects a page of the metrics of a namespace.
+type ListQuery struct {
+	// Prefix and Match filter names, Match is a glob like "signup{*}"
+	Prefix string
+	Match  string
+	// Sort is "name" (the default), "atime" (last update) or "total"
+	Sort string
+	// Desc sorts in descending order
+	Desc bool
+	// Limit is the page size, 0 means no limit
+	Limit int
+	// Cursor is the opaque position after the previous page
+	Cursor string
+}
+
+// listCursor is the position after the last metric of a page.
+type listCursor struct {
+	Sort string  `json:"s"`
+	Name string  `json:"n"`
+	Key  float64 `json:"k,omitempty"`
+}
+
+type listItem struct {
+	Metric
+	key float64
+}
+
+func (q *ListQuery) Validate() error {
+	if q.Sort != "" && q.Sort != "name" && q.Sort != "atime" && q.Sort != "total" {
+		return ErrSort
+	}
+	if q.Limit < 0 {
+		return ErrLimit
+	}
+	if _, err := path.Match(q.Match, ""); err != nil {
+		return err
+	}
+	if _, err := q.cursor(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (q *ListQuery) sort() string {
+	if q.Sort == "" {
+		return "name"
+	}
+	return q.Sort
+}
+
+func (q *ListQuery) match(name string) bool {
+	if q.Match == "" {
+		return true
+	}
+	ok, _ := path.Match(q.Match, name)
+	return ok
+}
+
+func (q *ListQuery) cursor() (*listCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrCursor
+	}
+	c := &listCursor{}
+	if err := json.Unmarshal(data, c); err != nil || c.Sort != q.sort() {
+		return nil, ErrCursor
+	}
+	return c, nil
+}
+
+func (c *listCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ListPage returns a page of the metrics of the namespace and the cursor of
+// the next page, empty if this is the last one. Pages sorted by name in
+// ascending order are read with a database cursor from the position of the
+// previous page; other orders need to read all counters of the namespace
+// and are more expensive.
+func (s *store) ListPage(ns string, q *ListQuery) (list []Metric, next string, err error) {
+	if err := q.Validate(); err != nil {
+		return nil, "", err
+	}
+	after, _ := q.cursor()
+	err = s.db.View(func(tx KVTx) error {
+		counters, derived := nsBucket(tx, IncrBucket, ns), nsBucket(tx, DerivedBucket, ns)
+		if q.sort() == "name" && !q.Desc {
+			list, next = pageByName(counters, derived, q, after)
+		} else if list, next, err = pageSorted(counters, derived, q, after); err != nil {
+			return err
+		}
+		get := getter(nsBucket(tx, MetaBucket, ns))
+		for i := range list {
+			if data := get([]byte(list[i].Name)); data != nil {
+				if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&list[i].MetricMeta); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return list, next, err
+}
+
+// pageByName merges counters and derived metrics in name order, seeking to
+// the prefix or the position of the previous page.
+func pageByName(counters, derived KVBucket, q *ListQuery, after *listCursor) ([]Metric, string) {
+	list := []Metric{}
+	prefix, start := []byte(q.Prefix), []byte(q.Prefix)
+	if after != nil && after.Name > q.Prefix {
+		start = []byte(after.Name)
+	}
+	seek := func(b KVBucket) (KVCursor, []byte) {
+		if b == nil {
+			return nil, nil
+		}
+		c := b.Cursor()
+		k, _ := c.Seek(start)
+		if k != nil && after != nil && string(k) == after.Name {
+			k, _ = c.Next()
+		}
+		if !bytes.HasPrefix(k, prefix) {
+			k = nil
+		}
+		return c, k
+	}
+	c, k := seek(counters)
+	d, dk := seek(derived)
+	for k != nil || dk != nil {
+		m := Metric{}
+		if dk == nil || (k != nil && bytes.Compare(k, dk) < 0) {
+			m.Name = string(k)
+			if k, _ = c.Next(); !bytes.HasPrefix(k, prefix) {
+				k = nil
+			}
+		} else {
+			m.Name, m.Derived = string(dk), true
+			if dk, _ = d.Next(); !bytes.HasPrefix(dk, prefix) {
+				dk = nil
+			}
+		}
+		if !q.match(m.Name) {
+			continue
+		}
+		if q.Limit > 0 && len(list) == q.Limit {
+			return list, (&listCursor{Sort: "name", Name: list[len(list)-1].Name}).String()
+		}
+		list = append(list, m)
+	}
+	return list, ""
+}
+
+// pageSorted reads all matching metrics, sorts them and returns the page
+// after the cursor. Derived metrics have no update time or total and sort as
+// zero.
+func pageSorted(counters, derived KVBucket, q *ListQuery, after *listCursor) ([]Metric, string, error) {
+	items := []listItem{}
+	for i, b := range []KVBucket{counters, derived} {
+		if b == nil {
+			continue
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(q.Prefix)); k != nil && bytes.HasPrefix(k, []byte(q.Prefix)); k, v = c.Next() {
+			if !q.match(string(k)) {
+				continue
+			}
+			item := listItem{Metric: Metric{Name: string(k), Derived: i == 1}}
+			if !item.Derived && q.sort() != "name" {
+				atime, total, err := counterStat(v)
+				if err != nil {
+					return nil, "", err
+				}
+				item.Atime, item.Total = &atime, &total
+				if q.sort() == "atime" {
+					item.key = float64(atime.Unix())
+				} else {
+					item.key = float64(total)
+				}
+			}
+			items = append(items, item)
+		}
+	}
+	desc := q.Desc
+	less := func(a, b *listItem) bool {
+		if a.key != b.key {
+			return (a.key < b.key) != desc
+		}
+		if a.Name == b.Name {
+			return false
+		}
+		return (a.Name < b.Name) != desc
+	}
+	sort.Slice(items, func(i, j int) bool { return less(&items[i], &items[j]) })
+	i := 0
+	if after != nil {
+		pos := &listItem{Metric: Metric{Name: after.Name}, key: after.Key}
+		i = sort.Search(len(items), func(i int) bool { return less(pos, &items[i]) })
+	}
+	list := []Metric{}
+	for ; i < len(items); i++ {
+		if q.Limit > 0 && len(list) == q.Limit {
+			last := items[i-1]
+			return list, (&listCursor{Sort: q.sort(), Name: last.Name, Key: last.key}).String(), nil
+		}
+		list = append(list, items[i].Metric)
+	}
+	return list, "", nil
+}
+
+// counterStat decodes the last update time and the total of a stored counter
+// without rolling it to the current time.
+func counterStat(data []byte) (time.Time, Value, error) {
+	c := Counter{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&c); err != nil {
+		return time.Time{}, 0, err
+	}
+	if c.Kind == "" {
+		c.Kind = KindCounter
+	}
+	c.initCounts()
+	return c.Atime, c.Values[BucketIndex("total")][0], nil
+}
+
+// listMetrics lists metrics of a namespace, a page at a time if the query
+// has a limit.
+func listMetrics(c *gin.Context, s Store) {
+	q, err := listQuery(c)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	if list, next, err := s.ListPage(c.Param("ns"), q); err != nil {
+		c.AbortWithStatus(500)
+	} else {
+		if next != "" {
+			c.Header("X-Next-Cursor", next)
+		}
+		respond(c, 200, list, func() proto.Message { return metricsToProto(list, next) })
+	}
+}
+
+// listQuery reads the listing options of GET /api/:ns.
+func listQuery(c *gin.Context) (*ListQuery, error) {
+	q := &ListQuery{
+		Prefix: c.Query("prefix"),
+		Match:  c.Query("match"),
+		Sort:   c.Query("sort"),
+		Cursor: c.Query("cursor"),
+	}
+	switch c.Query("order") {
+	case "":
+		q.Desc = q.Sort == "atime" || q.Sort == "total"
+	case "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return nil, ErrSort
+	}
+	if limit := c.Query("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, ErrLimit
+		}
+	}
+	return q, q.Validate()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// pages lists all pages of the query and returns the names joined by commas,
+// pages separated by "|".
+func pages(t *testing.T, s Store, ns string, q *ListQuery) string {
+	result := []string{}
+	for {
+		list, next, err := s.ListPage(ns, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, m := range list {
+			names = append(names, m.Name)
+		}
+		result = append(result, strings.Join(names, ","))
+		if next == "" {
+			return strings.Join(result, "|")
+		}
+		q.Cursor = next
+	}
+}
+
+func TestListPage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seconds = 0
+		for i, name := range []string{"a", "b", "c", "d", "e"} {
+			seconds = seconds + 10
+			for j := 0; j <= i%3; j++ {
+				s.Incr("foo", "x."+name)
+			}
+		}
+		s.Incr("foo", "y.a")
+		s.PutDerived("foo", "x.bb", "x.b * 2")
+
+		if p := pages(t, s, "foo", &ListQuery{Limit: 2}); p != "x.a,x.b|x.bb,x.c|x.d,x.e|y.a" {
+			t.Error(p)
+		}
+		if p := pages(t, s, "foo", &ListQuery{Prefix: "x.", Limit: 3}); p != "x.a,x.b,x.bb|x.c,x.d,x.e" {
+			t.Error(p)
+		}
+		if p := pages(t, s, "foo", &ListQuery{Match: "*.a", Limit: 1}); p != "x.a|y.a" {
+			t.Error(p)
+		}
+		// Totals are 1, 2, 3, 1, 2 and 1, derived metrics sort as zero
+		if p := pages(t, s, "foo", &ListQuery{Sort: "total", Desc: true, Limit: 2}); p != "x.c,x.e|x.b,y.a|x.d,x.a|x.bb" {
+			t.Error(p)
+		}
+		if p := pages(t, s, "foo", &ListQuery{Sort: "atime", Desc: true, Prefix: "x.", Limit: 4}); p != "x.e,x.d,x.c,x.b|x.a,x.bb" {
+			t.Error(p)
+		}
+		if p := pages(t, s, "foo", &ListQuery{Sort: "name", Desc: true, Limit: 4}); p != "y.a,x.e,x.d,x.c|x.bb,x.b,x.a" {
+			t.Error(p)
+		}
+		if list, _, _ := s.ListPage("foo", &ListQuery{Sort: "total", Prefix: "x.c"}); list[0].Total == nil || *list[0].Total != 3 {
+			t.Error(list)
+		}
+		if p := pages(t, s, "bar", &ListQuery{Limit: 2}); p != "" {
+			t.Error(p)
+		}
+
+		if _, _, err := s.ListPage("foo", &ListQuery{Sort: "size"}); err != ErrSort {
+			t.Error(err)
+		}
+		if _, _, err := s.ListPage("foo", &ListQuery{Cursor: "garbage"}); err != ErrCursor {
+			t.Error(err)
+		}
+		_, next, _ := s.ListPage("foo", &ListQuery{Limit: 1})
+		if _, _, err := s.ListPage("foo", &ListQuery{Sort: "total", Cursor: next}); err != ErrCursor {
+			t.Error(err)
+		}
+		if _, _, err := s.ListPage("foo", &ListQuery{Match: "[a"}); err == nil {
+			t.Error("invalid pattern accepted")
+		}
+	})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LogCompactSize is the size the transaction log of the log backend may grow
+// to before it is compacted, as long as it is at least twice the size of the
+// records.
+var LogCompactSize int64 = 64 << 20
+
+// LogRecordSize is the approximate size of the records the log is compacted
+// into, records are limited to 4 GiB.
+var LogRecordSize = 16 << 20
+
+// logBackend keeps records in memory like the mem backend and appends every
+// committed write transaction to a file, which is replayed on open. It is
+// durable, but all records have to fit in memory. The log is compacted to a
+// single transaction with all records on open and when it grows too big.
+type logBackend struct {
+	*memBackend
+	mu        sync.Mutex
+	path      string
+	f         *os.File
+	size      int64
+	compacted int64
+	deferred  bool
+}
+
+// logTx is a committed write transaction in the log, with the same
+// operations as replicated ones.
+type logTx struct {
+	Ops []ReplOp
+}
+
+func OpenLog(path string) (Backend, error) {
+	db, _ := OpenMem("")
+	l := &logBackend{memBackend: db.(*memBackend), path: path}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = l.replay(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// replay applies the transactions of the log. A torn transaction at the end,
+// left by a crash in the middle of a write, was never committed and is
+// dropped. A corrupt one followed by others is an error: dropping it would
+// lose the committed transactions after it.
+func (l *logBackend) replay(r *bufio.Reader) error {
+	for {
+		t := logTx{}
+		if err := readRecord(r, &t); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err == ErrCorrupt {
+			if _, err := r.Peek(1); err == io.EOF {
+				return nil
+			}
+			return ErrCorrupt
+		} else if err != nil {
+			return err
+		}
+		if err := l.memBackend.Update(func(tx KVTx) error {
+			for _, op := range t.Ops {
+				if err := applyOp(tx, op); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// Update logs the changes made by fn before they are visible to others. If
+// the log can't be written the transaction is rolled back.
+func (l *logBackend) Update(fn func(tx KVTx) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return ErrClosed
+	}
+	t := logTx{}
+	if err := l.memBackend.Update(func(tx KVTx) error {
+		if err := fn(&replTx{KVTx: tx, ops: &t.Ops}); err != nil || len(t.Ops) == 0 {
+			return err
+		}
+		return l.append(&t)
+	}); err != nil {
+		return err
+	}
+	if l.size >= LogCompactSize && l.size >= 2*l.compacted {
+		// The transaction is committed already, a failed compaction only
+		// leaves a longer log
+		if err := l.compact(); err != nil {
+			log.Println("log compaction:", err)
+		}
+	}
+	return nil
+}
+
+// append writes the transaction at the end of the log, mu must be held.
+func (l *logBackend) append(t *logTx) error {
+	buf := &bytes.Buffer{}
+	if err := writeRecord(buf, t); err != nil {
+		return err
+	}
+	if _, err := l.f.WriteAt(buf.Bytes(), l.size); err != nil {
+		l.f.Truncate(l.size)
+		return err
+	} else if !l.deferred {
+		if err := l.f.Sync(); err != nil {
+			l.f.Truncate(l.size)
+			return err
+		}
+	}
+	l.size += int64(buf.Len())
+	return nil
+}
+
+// compact replaces the log with a new one that has all records in as few
+// transactions of about LogRecordSize as possible. Writes must be blocked by
+// mu or not started yet.
+func (l *logBackend) compact() error {
+	ops := []ReplOp{}
+	l.memBackend.RLock()
+	for _, name := range l.root.keys {
+		ops = snapshotOps(ops, l.root.buckets[name], []byte(name), nil)
+	}
+	l.memBackend.RUnlock()
+
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	size, err := writeSnapshot(f, ops)
+	if err != nil {
+		f.Close()
+		return err
+	} else if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err := os.Rename(tmp, l.path); err != nil {
+		f.Close()
+		return err
+	}
+	// The rename is durable once the directory is synced
+	if dir, err := os.Open(filepath.Dir(l.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, l.size, l.compacted = f, size, size
+	return nil
+}
+
+// writeSnapshot writes the operations as transactions of about LogRecordSize
+// and returns the number of bytes written. Replaying a part of them is never
+// needed, the snapshot only replaces the log once it is complete.
+func writeSnapshot(w io.Writer, ops []ReplOp) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	t, n := logTx{}, 0
+	for i, op := range ops {
+		t.Ops = append(t.Ops, op)
+		n += len(op.Bucket) + len(op.Key) + len(op.Value) + 16
+		for _, p := range op.Path {
+			n += len(p)
+		}
+		if n >= LogRecordSize || i == len(ops)-1 {
+			if err := writeRecord(cw, &t); err != nil {
+				return 0, err
+			}
+			t, n = logTx{}, 0
+		}
+	}
+	return cw.n, bw.Flush()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// snapshotOps appends operations that create the bucket at path with its
+// sequence, records and nested buckets.
+func snapshotOps(ops []ReplOp, b *memBucket, bucket []byte, path [][]byte) []ReplOp {
+	ops = append(ops, ReplOp{Op: "create", Bucket: bucket, Path: path})
+	if b.seq > 0 {
+		ops = append(ops, ReplOp{Op: "seq", Bucket: bucket, Path: path, Seq: b.seq})
+	}
+	for _, k := range b.keys {
+		if nested, ok := b.buckets[k]; ok {
+			ops = snapshotOps(ops, nested, bucket, append(append([][]byte{}, path...), []byte(k)))
+		} else {
+			ops = append(ops, ReplOp{Op: "put", Bucket: bucket, Path: path, Key: []byte(k), Value: b.m[k]})
+		}
+	}
+	return ops
+}
+
+// DeferSync leaves fsync of committed transactions to Sync, see
+// deferredSync.
+func (l *logBackend) DeferSync() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deferred = true
+}
+
+func (l *logBackend) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return ErrClosed
+	}
+	return l.f.Sync()
+}
+
+func (l *logBackend) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
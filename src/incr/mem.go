@@ -0,0 +1,299 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// memBackend keeps records in memory, for tests and ephemeral deployments.
+// Write transactions are exclusive and keep an undo log, so that they can be
+// rolled back like bolt ones.
+type memBackend struct {
+	sync.RWMutex
+	root *memBucket
+}
+
+// memBucket keeps records and nested buckets, keys has the keys of both in
+// order.
+type memBucket struct {
+	m       map[string][]byte
+	buckets map[string]*memBucket
+	keys    []string
+	seq     uint64
+}
+
+type memTx struct {
+	db       *memBackend
+	writable bool
+	undo     []func()
+}
+
+type memTxBucket struct {
+	tx *memTx
+	b  *memBucket
+}
+
+type memCursor struct {
+	b   *memBucket
+	key string
+}
+
+func OpenMem(path string) (Backend, error) {
+	return &memBackend{root: newMemBucket()}, nil
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{m: map[string][]byte{}, buckets: map[string]*memBucket{}}
+}
+
+func (db *memBackend) View(fn func(tx KVTx) error) error {
+	db.RLock()
+	defer db.RUnlock()
+	return fn(&memTx{db: db})
+}
+
+func (db *memBackend) Update(fn func(tx KVTx) error) error {
+	db.Lock()
+	defer db.Unlock()
+	tx := &memTx{db: db, writable: true}
+	if err := fn(tx); err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return err
+	}
+	return nil
+}
+
+// Backup writes the records as a bolt database, so a snapshot of an
+// in-memory store can be restored into a persistent one.
+func (db *memBackend) Backup(w io.Writer) (n int64, err error) {
+	f, err := ioutil.TempFile("", "incr-backup")
+	if err != nil {
+		return 0, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	snapshot, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Close()
+
+	db.RLock()
+	err = snapshot.Update(func(tx *bolt.Tx) error {
+		for name, m := range db.root.buckets {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			} else if err := m.backup(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	err = snapshot.View(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+func (db *memBackend) Close() error {
+	return nil
+}
+
+func (m *memBucket) backup(b *bolt.Bucket) error {
+	// Sequences continue after a restore, bolt can only step them
+	for seq := uint64(0); seq < m.seq; {
+		var err error
+		if seq, err = b.NextSequence(); err != nil {
+			return err
+		}
+	}
+	for _, k := range m.keys {
+		if nested, ok := m.buckets[k]; ok {
+			nb, err := b.CreateBucket([]byte(k))
+			if err != nil {
+				return err
+			} else if err := nested.backup(nb); err != nil {
+				return err
+			}
+		} else if err := b.Put([]byte(k), m.m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memTx) root() *memTxBucket {
+	return &memTxBucket{tx: tx, b: tx.db.root}
+}
+
+func (tx *memTx) Bucket(name []byte) KVBucket {
+	return tx.root().Bucket(name)
+}
+
+func (tx *memTx) CreateBucketIfNotExists(name []byte) (KVBucket, error) {
+	return tx.root().CreateBucketIfNotExists(name)
+}
+
+func (tx *memTx) DeleteBucket(name []byte) error {
+	return tx.root().DeleteBucket(name)
+}
+
+func (tx *memTx) ForEach(fn func(name []byte, b KVBucket) error) error {
+	for _, name := range append([]string{}, tx.db.root.keys...) {
+		if err := fn([]byte(name), tx.Bucket([]byte(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memTxBucket) Get(key []byte) []byte {
+	return b.b.m[string(key)]
+}
+
+func (b *memTxBucket) Put(key, value []byte) error {
+	k := string(key)
+	if !b.tx.writable {
+		return bolt.ErrTxNotWritable
+	} else if _, ok := b.b.buckets[k]; ok {
+		return bolt.ErrIncompatibleValue
+	}
+	if old, ok := b.b.m[k]; ok {
+		b.tx.undo = append(b.tx.undo, func() { b.b.m[k] = old })
+	} else {
+		b.b.insert(k)
+		b.tx.undo = append(b.tx.undo, func() {
+			b.b.remove(k)
+			delete(b.b.m, k)
+		})
+	}
+	b.b.m[k] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memTxBucket) Delete(key []byte) error {
+	k := string(key)
+	if !b.tx.writable {
+		return bolt.ErrTxNotWritable
+	} else if _, ok := b.b.buckets[k]; ok {
+		return bolt.ErrIncompatibleValue
+	}
+	if old, ok := b.b.m[k]; ok {
+		b.b.remove(k)
+		delete(b.b.m, k)
+		b.tx.undo = append(b.tx.undo, func() {
+			b.b.insert(k)
+			b.b.m[k] = old
+		})
+	}
+	return nil
+}
+
+func (b *memTxBucket) NextSequence() (uint64, error) {
+	if !b.tx.writable {
+		return 0, bolt.ErrTxNotWritable
+	}
+	b.b.seq++
+	b.tx.undo = append(b.tx.undo, func() { b.b.seq-- })
+	return b.b.seq, nil
+}
+
+func (b *memTxBucket) KeyN() int {
+	return len(b.b.keys)
+}
+
+func (b *memTxBucket) Bucket(name []byte) KVBucket {
+	if nested, ok := b.b.buckets[string(name)]; ok {
+		return &memTxBucket{tx: b.tx, b: nested}
+	}
+	return nil
+}
+
+func (b *memTxBucket) CreateBucketIfNotExists(name []byte) (KVBucket, error) {
+	k := string(name)
+	if nested := b.Bucket(name); nested != nil {
+		return nested, nil
+	} else if !b.tx.writable {
+		return nil, bolt.ErrTxNotWritable
+	} else if len(name) == 0 {
+		return nil, bolt.ErrBucketNameRequired
+	} else if _, ok := b.b.m[k]; ok {
+		return nil, bolt.ErrIncompatibleValue
+	}
+	b.b.buckets[k] = newMemBucket()
+	b.b.insert(k)
+	b.tx.undo = append(b.tx.undo, func() {
+		b.b.remove(k)
+		delete(b.b.buckets, k)
+	})
+	return b.Bucket(name), nil
+}
+
+func (b *memTxBucket) DeleteBucket(name []byte) error {
+	k := string(name)
+	nested, ok := b.b.buckets[k]
+	if !b.tx.writable {
+		return bolt.ErrTxNotWritable
+	} else if !ok {
+		return bolt.ErrBucketNotFound
+	}
+	b.b.remove(k)
+	delete(b.b.buckets, k)
+	b.tx.undo = append(b.tx.undo, func() {
+		b.b.insert(k)
+		b.b.buckets[k] = nested
+	})
+	return nil
+}
+
+func (b *memTxBucket) Cursor() KVCursor {
+	return &memCursor{b: b.b}
+}
+
+// insert adds a new key to the sorted keys, remove deletes it.
+func (b *memBucket) insert(k string) {
+	i := sort.SearchStrings(b.keys, k)
+	b.keys = append(b.keys, "")
+	copy(b.keys[i+1:], b.keys[i:])
+	b.keys[i] = k
+}
+
+func (b *memBucket) remove(k string) {
+	i := sort.SearchStrings(b.keys, k)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+}
+
+// The cursor remembers the last key rather than a position, so it keeps
+// working if records are added or deleted while iterating.
+func (c *memCursor) at(i int) ([]byte, []byte) {
+	if i >= len(c.b.keys) {
+		return nil, nil
+	}
+	c.key = c.b.keys[i]
+	return []byte(c.key), c.b.m[c.key]
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(sort.SearchStrings(c.b.keys, string(seek)))
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	return c.at(sort.Search(len(c.b.keys), func(i int) bool { return c.b.keys[i] > c.key }))
+}
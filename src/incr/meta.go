@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrMeta = errors.New("invalid metric metadata")
+
+// Charts are the chart types a metric can be displayed with.
+var Charts = []string{"line", "bar"}
+
+// MetricMeta describes a metric for people, it is shown by the dashboard.
+type MetricMeta struct {
+	Description string `json:"description,omitempty"`
+	// Unit of the values, e.g. "ms", "bytes" or "$"
+	Unit string `json:"unit,omitempty"`
+	// Chart is the preferred chart type, one of Charts
+	Chart string `json:"chart,omitempty"`
+	// Hidden metrics are listed but not shown by the dashboard
+	Hidden bool `json:"hidden,omitempty"`
+}
+
+func (m *MetricMeta) Validate() error {
+	if len(m.Description) > 1024 || len(m.Unit) > 16 {
+		return ErrMeta
+	}
+	if m.Chart != "" {
+		for _, chart := range Charts {
+			if m.Chart == chart {
+				return nil
+			}
+		}
+		return ErrMeta
+	}
+	return nil
+}
+
+func getMeta(c *gin.Context, s Store) {
+	if meta, err := s.Meta(c.Param("ns"), c.Param("counter")); err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.JSON(200, meta)
+	}
+}
+
+func putMeta(c *gin.Context, s Store) {
+	meta := &MetricMeta{}
+	if c.BindJSON(meta) != nil {
+		return
+	}
+	if err := meta.Validate(); err != nil {
+		c.String(400, err.Error())
+	} else if err := s.PutMeta(c.Param("ns"), c.Param("counter"), meta); err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.JSON(200, meta)
+	}
+}
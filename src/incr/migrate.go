@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+)
+
+// migrate upgrades all stored records written by older versions, see
+// migrateLayout and migrateCounters. It works in small transactions so that a
+// large database doesn't need to fit in a single one.
+func migrate(db Backend) error {
+	if err := migrateLayout(db); err != nil {
+		return err
+	}
+	namespaces := [][]byte{}
+	if err := db.View(func(tx KVTx) error {
+		c := tx.Bucket(IncrBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			namespaces = append(namespaces, append([]byte{}, k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	n := 0
+	for _, ns := range namespaces {
+		migrated, err := migrateCounters(db, ns)
+		if err != nil {
+			return err
+		}
+		n = n + migrated
+	}
+	if n > 0 {
+		log.Printf("migrated %d counters", n)
+	}
+	return nil
+}
+
+// migrateLayout moves records of the flat layout of older versions, kept by
+// "ns:name" keys in IncrBucket, DerivedBucket and AlertsBucket, into nested
+// buckets of their namespaces. The namespace of a metric is the part of the
+// key before the first ":", rules know their own.
+func migrateLayout(db Backend) error {
+	const batch = 1000
+	n := 0
+	for _, bucket := range [][]byte{IncrBucket, DerivedBucket, AlertsBucket} {
+		var next []byte
+		for done := false; !done; {
+			if err := db.Update(func(tx KVTx) error {
+				b := tx.Bucket(bucket)
+				cur := b.Cursor()
+				k, v := cur.First()
+				if next != nil {
+					k, v = cur.Seek(next)
+				}
+				type kv struct{ k, v []byte }
+				flat := []kv{}
+				// Nested buckets have nil values
+				for ; k != nil && len(flat) < batch; k, v = cur.Next() {
+					if v != nil && bytes.IndexByte(k, ':') >= 0 {
+						flat = append(flat, kv{append([]byte{}, k...), append([]byte{}, v...)})
+					}
+				}
+				next, done = append([]byte{}, k...), k == nil
+				for _, r := range flat {
+					i := bytes.IndexByte(r.k, ':')
+					ns, key := string(r.k[:i]), r.k[i+1:]
+					if bytes.Equal(bucket, AlertsBucket) {
+						rule := Rule{}
+						if err := gob.NewDecoder(bytes.NewBuffer(r.v)).Decode(&rule); err != nil {
+							return err
+						}
+						ns, key = rule.NS, []byte(rule.ID)
+					}
+					// Namespaces are not registered, their creation time is unknown
+					nb, err := b.CreateBucketIfNotExists([]byte(ns))
+					if err != nil {
+						return err
+					} else if err := nb.Put(key, r.v); err != nil {
+						return err
+					} else if err := b.Delete(r.k); err != nil {
+						return err
+					}
+				}
+				n = n + len(flat)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	if n > 0 {
+		log.Printf("moved %d records to namespace buckets", n)
+	}
+	return nil
+}
+
+// migrateCounters upgrades counters of the namespace: they are relabelled to
+// Alignment and counting kinds get exact counts instead of float32 values.
+func migrateCounters(db Backend, ns []byte) (int, error) {
+	const batch = 1000
+	n := 0
+	var next []byte
+	for done := false; !done; {
+		if err := db.Update(func(tx KVTx) error {
+			b := tx.Bucket(IncrBucket).Bucket(ns)
+			cur := b.Cursor()
+			k, v := cur.First()
+			if next != nil {
+				k, v = cur.Seek(next)
+			}
+			type kv struct{ k, v []byte }
+			pending := []kv{}
+			loc := location(tx, string(ns))
+			for i := 0; k != nil && i < batch; i++ {
+				c := Counter{loc: loc}
+				if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&c); err != nil {
+					return err
+				}
+				if c.Kind == "" {
+					c.Kind = KindCounter
+				}
+				if c.Align != Alignment || (c.counting() && c.Counts == nil) {
+					c.Relabel(Alignment)
+					pending = append(pending, kv{append([]byte{}, k...), c.Bytes()})
+				}
+				k, v = cur.Next()
+			}
+			next, done = append([]byte{}, k...), k == nil
+			for _, p := range pending {
+				if err := b.Put(p.k, p.v); err != nil {
+					return err
+				}
+			}
+			n = n + len(pending)
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrName = errors.New("namespace name required")
+var ErrTimeZone = errors.New("time zone of a namespace with metrics can't change")
+
+// Namespace keeps settings and information of a namespace. Namespaces are
+// registered when they are created explicitly or get their first record.
+type Namespace struct {
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name"`
+	Owner       string    `json:"owner"`
+	Created     time.Time `json:"created"`
+	// TimeZone aligns buckets with the calendar of the zone, e.g.
+	// "Europe/Berlin". Empty means fixed periods in UTC.
+	TimeZone string `json:"timezone"`
+	// Retention is how long metrics without updates are kept, e.g. "2160h".
+	// Empty keeps them forever.
+	Retention string `json:"retention"`
+	// Metrics is the number of metrics with data, it is not stored
+	Metrics int `json:"metrics"`
+}
+
+func (n *Namespace) Validate() error {
+	if n.Name == "" {
+		return ErrName
+	}
+	if n.TimeZone != "" {
+		if _, err := LoadLocation(n.TimeZone); err != nil {
+			return err
+		}
+	}
+	if n.Retention != "" {
+		if d, err := time.ParseDuration(n.Retention); err != nil {
+			return err
+		} else if d <= 0 {
+			return fmt.Errorf("retention must be positive: %s", n.Retention)
+		}
+	}
+	return nil
+}
+
+// Location returns the time zone of the namespace, or nil if it has none.
+func (n *Namespace) Location() *time.Location {
+	if n.TimeZone == "" {
+		return nil
+	}
+	loc, _ := LoadLocation(n.TimeZone)
+	return loc
+}
+
+func listNamespaces(c *gin.Context, s Store) {
+	if list, err := s.Namespaces(); err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.JSON(200, list)
+	}
+}
+
+func createNamespace(c *gin.Context, s Store) {
+	n := &Namespace{}
+	if c.BindJSON(n) != nil {
+		return
+	}
+	if err := n.Validate(); err != nil {
+		c.String(400, err.Error())
+	} else if err := s.CreateNamespace(n); err == ErrExists {
+		c.String(409, err.Error())
+	} else if err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		getNamespace(c, s, n.Name, 201)
+	}
+}
+
+func getNamespace(c *gin.Context, s Store, ns string, status int) {
+	if n, err := s.Namespace(ns); err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.JSON(status, n)
+	}
+}
+
+func putNamespace(c *gin.Context, s Store) {
+	n := &Namespace{}
+	if c.BindJSON(n) != nil {
+		return
+	}
+	n.Name = c.Param("ns")
+	if err := n.Validate(); err != nil {
+		c.String(400, err.Error())
+	} else if err := s.PutNamespace(n); err == ErrTimeZone {
+		c.String(409, err.Error())
+	} else if err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		getNamespace(c, s, n.Name, 200)
+	}
+}
+
+// deleteNamespace removes the namespace with all its metrics, derived
+// metrics and alert rules.
+func deleteNamespace(c *gin.Context, s Store) {
+	if err := s.DeleteNamespace(c.Param("ns")); err == ErrNotFound {
+		c.AbortWithStatus(404)
+	} else if err != nil {
+		c.AbortWithError(500, err)
+	} else {
+		c.AbortWithStatus(200)
+	}
+}
@@ -0,0 +1,290 @@
+// Code generated by protoc-gen-go.
+// source: incr.proto
+// DO NOT EDIT!
+
+/*
+Package pb is a generated protocol buffer package.
+
+It is generated from these files:
+
+	incr.proto
+
+It has these top-level messages:
+
+	Event
+	Batch
+	Result
+	BatchResult
+	Metric
+	Metrics
+	Series
+	Counter
+	TopItem
+	TopSlot
+	Top
+*/
+package pb
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+const _ = proto.ProtoPackageIsVersion1
+
+// Event is a single submitted metric value, see Event in the JSON batch API.
+type Event struct {
+	Metric string            `protobuf:"bytes,1,opt,name=metric" json:"metric,omitempty"`
+	Type   string            `protobuf:"bytes,2,opt,name=type" json:"type,omitempty"`
+	Value  float64           `protobuf:"fixed64,3,opt,name=value" json:"value,omitempty"`
+	Ts     int64             `protobuf:"varint,4,opt,name=ts" json:"ts,omitempty"`
+	Labels map[string]string `protobuf:"bytes,5,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Item is the value of top-K metrics
+	Item string `protobuf:"bytes,6,opt,name=item" json:"item,omitempty"`
+}
+
+func (m *Event) Reset()                    { *m = Event{} }
+func (m *Event) String() string            { return proto.CompactTextString(m) }
+func (*Event) ProtoMessage()               {}
+func (*Event) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+func (m *Event) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+// Batch is the body of POST /api/:ns/batch.
+type Batch struct {
+	Events []*Event `protobuf:"bytes,1,rep,name=events" json:"events,omitempty"`
+}
+
+func (m *Batch) Reset()                    { *m = Batch{} }
+func (m *Batch) String() string            { return proto.CompactTextString(m) }
+func (*Batch) ProtoMessage()               {}
+func (*Batch) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+func (m *Batch) GetEvents() []*Event {
+	if m != nil {
+		return m.Events
+	}
+	return nil
+}
+
+type Result struct {
+	Status string `protobuf:"bytes,1,opt,name=status" json:"status,omitempty"`
+	Error  string `protobuf:"bytes,2,opt,name=error" json:"error,omitempty"`
+}
+
+func (m *Result) Reset()                    { *m = Result{} }
+func (m *Result) String() string            { return proto.CompactTextString(m) }
+func (*Result) ProtoMessage()               {}
+func (*Result) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+// BatchResult is the response to a Batch, one result per event.
+type BatchResult struct {
+	Results []*Result `protobuf:"bytes,1,rep,name=results" json:"results,omitempty"`
+}
+
+func (m *BatchResult) Reset()                    { *m = BatchResult{} }
+func (m *BatchResult) String() string            { return proto.CompactTextString(m) }
+func (*BatchResult) ProtoMessage()               {}
+func (*BatchResult) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *BatchResult) GetResults() []*Result {
+	if m != nil {
+		return m.Results
+	}
+	return nil
+}
+
+// Metric is a metric of a namespace with its metadata.
+type Metric struct {
+	Name        string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Derived     bool   `protobuf:"varint,2,opt,name=derived" json:"derived,omitempty"`
+	Description string `protobuf:"bytes,3,opt,name=description" json:"description,omitempty"`
+	Unit        string `protobuf:"bytes,4,opt,name=unit" json:"unit,omitempty"`
+	Chart       string `protobuf:"bytes,5,opt,name=chart" json:"chart,omitempty"`
+	Hidden      bool   `protobuf:"varint,6,opt,name=hidden" json:"hidden,omitempty"`
+	// Atime (unix time of the last update) and total are set when the
+	// listing is sorted by them
+	Atime int64   `protobuf:"varint,7,opt,name=atime" json:"atime,omitempty"`
+	Total float64 `protobuf:"fixed64,8,opt,name=total" json:"total,omitempty"`
+}
+
+func (m *Metric) Reset()                    { *m = Metric{} }
+func (m *Metric) String() string            { return proto.CompactTextString(m) }
+func (*Metric) ProtoMessage()               {}
+func (*Metric) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+// Metrics is the response to GET /api/:ns. Names are kept for older
+// clients.
+type Metrics struct {
+	Names   []string  `protobuf:"bytes,1,rep,name=names" json:"names,omitempty"`
+	Metrics []*Metric `protobuf:"bytes,2,rep,name=metrics" json:"metrics,omitempty"`
+	// Next is the cursor of the next page, empty on the last one
+	Next string `protobuf:"bytes,3,opt,name=next" json:"next,omitempty"`
+}
+
+func (m *Metrics) Reset()                    { *m = Metrics{} }
+func (m *Metrics) String() string            { return proto.CompactTextString(m) }
+func (*Metrics) ProtoMessage()               {}
+func (*Metrics) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *Metrics) GetMetrics() []*Metric {
+	if m != nil {
+		return m.Metrics
+	}
+	return nil
+}
+
+type Series struct {
+	Bucket string    `protobuf:"bytes,1,opt,name=bucket" json:"bucket,omitempty"`
+	Values []float64 `protobuf:"fixed64,2,rep,packed,name=values" json:"values,omitempty"`
+	// Stat is the percentile name for timer percentile series, e.g. "p99"
+	Stat string `protobuf:"bytes,3,opt,name=stat" json:"stat,omitempty"`
+}
+
+func (m *Series) Reset()                    { *m = Series{} }
+func (m *Series) String() string            { return proto.CompactTextString(m) }
+func (*Series) ProtoMessage()               {}
+func (*Series) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+// Counter is the response to GET /api/:ns/:counter.
+type Counter struct {
+	Type        string    `protobuf:"bytes,1,opt,name=type" json:"type,omitempty"`
+	Now         int64     `protobuf:"varint,2,opt,name=now" json:"now,omitempty"`
+	Series      []*Series `protobuf:"bytes,3,rep,name=series" json:"series,omitempty"`
+	Percentiles []*Series `protobuf:"bytes,4,rep,name=percentiles" json:"percentiles,omitempty"`
+	Top         []*Top    `protobuf:"bytes,5,rep,name=top" json:"top,omitempty"`
+}
+
+func (m *Counter) Reset()                    { *m = Counter{} }
+func (m *Counter) String() string            { return proto.CompactTextString(m) }
+func (*Counter) ProtoMessage()               {}
+func (*Counter) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *Counter) GetSeries() []*Series {
+	if m != nil {
+		return m.Series
+	}
+	return nil
+}
+
+func (m *Counter) GetPercentiles() []*Series {
+	if m != nil {
+		return m.Percentiles
+	}
+	return nil
+}
+
+func (m *Counter) GetTop() []*Top {
+	if m != nil {
+		return m.Top
+	}
+	return nil
+}
+
+type TopItem struct {
+	Item  string `protobuf:"bytes,1,opt,name=item" json:"item,omitempty"`
+	Count uint64 `protobuf:"varint,2,opt,name=count" json:"count,omitempty"`
+}
+
+func (m *TopItem) Reset()                    { *m = TopItem{} }
+func (m *TopItem) String() string            { return proto.CompactTextString(m) }
+func (*TopItem) ProtoMessage()               {}
+func (*TopItem) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+type TopSlot struct {
+	Items []*TopItem `protobuf:"bytes,1,rep,name=items" json:"items,omitempty"`
+}
+
+func (m *TopSlot) Reset()                    { *m = TopSlot{} }
+func (m *TopSlot) String() string            { return proto.CompactTextString(m) }
+func (*TopSlot) ProtoMessage()               {}
+func (*TopSlot) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *TopSlot) GetItems() []*TopItem {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
+// Top is the ranked items of every slot of a bucket of a top-K metric.
+type Top struct {
+	Bucket string     `protobuf:"bytes,1,opt,name=bucket" json:"bucket,omitempty"`
+	Slots  []*TopSlot `protobuf:"bytes,2,rep,name=slots" json:"slots,omitempty"`
+}
+
+func (m *Top) Reset()                    { *m = Top{} }
+func (m *Top) String() string            { return proto.CompactTextString(m) }
+func (*Top) ProtoMessage()               {}
+func (*Top) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *Top) GetSlots() []*TopSlot {
+	if m != nil {
+		return m.Slots
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Event)(nil), "pb.Event")
+	proto.RegisterType((*Batch)(nil), "pb.Batch")
+	proto.RegisterType((*Result)(nil), "pb.Result")
+	proto.RegisterType((*BatchResult)(nil), "pb.BatchResult")
+	proto.RegisterType((*Metric)(nil), "pb.Metric")
+	proto.RegisterType((*Metrics)(nil), "pb.Metrics")
+	proto.RegisterType((*Series)(nil), "pb.Series")
+	proto.RegisterType((*Counter)(nil), "pb.Counter")
+	proto.RegisterType((*TopItem)(nil), "pb.TopItem")
+	proto.RegisterType((*TopSlot)(nil), "pb.TopSlot")
+	proto.RegisterType((*Top)(nil), "pb.Top")
+}
+
+var fileDescriptor0 = []byte{
+	// 559 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x74, 0x54, 0xc1, 0x6e, 0xd3, 0x40,
+	0x10, 0xd5, 0xc6, 0xb5, 0xdd, 0x4c, 0x24, 0x54, 0xad, 0x00, 0x2d, 0x9c, 0x52, 0x8b, 0x43, 0x84,
+	0x4a, 0x0e, 0x54, 0x42, 0xc0, 0x09, 0x81, 0x7a, 0x40, 0x2a, 0x97, 0x6d, 0x2f, 0x1c, 0x1d, 0x67,
+	0xa4, 0x5a, 0x75, 0xbc, 0xd6, 0xee, 0xb8, 0xd0, 0x7f, 0xe1, 0x7b, 0xf8, 0x05, 0x7e, 0x07, 0xcd,
+	0xec, 0x3a, 0x89, 0x90, 0xb8, 0xcd, 0x9b, 0x19, 0xcf, 0x7b, 0xfb, 0x66, 0xd7, 0x00, 0x6d, 0xdf,
+	0xf8, 0xf5, 0xe0, 0x1d, 0x39, 0x3d, 0x1b, 0x36, 0xd5, 0x1f, 0x05, 0xf9, 0xd5, 0x03, 0xf6, 0xa4,
+	0x9f, 0x43, 0xb1, 0x43, 0xf2, 0x6d, 0x63, 0xd4, 0x52, 0xad, 0xe6, 0x36, 0x21, 0xad, 0xe1, 0x84,
+	0x1e, 0x07, 0x34, 0x33, 0xc9, 0x4a, 0xac, 0x9f, 0x42, 0xfe, 0x50, 0x77, 0x23, 0x9a, 0x6c, 0xa9,
+	0x56, 0xca, 0x46, 0xa0, 0x9f, 0xc0, 0x8c, 0x82, 0x39, 0x59, 0xaa, 0x55, 0x66, 0x67, 0x14, 0xf4,
+	0x1b, 0x28, 0xba, 0x7a, 0x83, 0x5d, 0x30, 0xf9, 0x32, 0x5b, 0x2d, 0xde, 0x3e, 0x5b, 0x0f, 0x9b,
+	0xb5, 0x90, 0xad, 0xaf, 0x25, 0x7f, 0xd5, 0x93, 0x7f, 0xb4, 0xa9, 0x89, 0x89, 0x5a, 0xc2, 0x9d,
+	0x29, 0x22, 0x11, 0xc7, 0x2f, 0x3f, 0xc0, 0xe2, 0xa8, 0x55, 0x9f, 0x41, 0x76, 0x8f, 0x8f, 0x49,
+	0x20, 0x87, 0x07, 0x25, 0x51, 0x5e, 0x04, 0x1f, 0x67, 0xef, 0x55, 0xf5, 0x1a, 0xf2, 0xcf, 0x35,
+	0x35, 0x77, 0xfa, 0x1c, 0x0a, 0x64, 0xd2, 0x60, 0x94, 0xc8, 0x98, 0xef, 0x65, 0xd8, 0x54, 0xa8,
+	0xde, 0x41, 0x61, 0x31, 0x8c, 0x9d, 0xb8, 0x10, 0xa8, 0xa6, 0x31, 0x4c, 0x2e, 0x44, 0xc4, 0x3c,
+	0xe8, 0xbd, 0xf3, 0x13, 0x8f, 0x80, 0xea, 0x12, 0x16, 0xc2, 0x91, 0x3e, 0x7e, 0x05, 0xa5, 0x97,
+	0x68, 0xa2, 0x02, 0xa6, 0x8a, 0x45, 0x3b, 0x95, 0xaa, 0xdf, 0x0a, 0x8a, 0x6f, 0x7b, 0x6f, 0xfb,
+	0x7a, 0x87, 0x89, 0x4b, 0x62, 0x6d, 0xa0, 0xdc, 0xa2, 0x6f, 0x1f, 0x70, 0x2b, 0x5c, 0xa7, 0x76,
+	0x82, 0x7a, 0x09, 0x8b, 0x2d, 0x86, 0xc6, 0xb7, 0x03, 0xb5, 0xae, 0x17, 0xef, 0xe7, 0xf6, 0x38,
+	0xc5, 0xf3, 0xc6, 0xbe, 0x25, 0xd9, 0xc1, 0xdc, 0x4a, 0xcc, 0xca, 0x9b, 0xbb, 0xda, 0x93, 0xc9,
+	0xa3, 0x72, 0x01, 0x7c, 0xce, 0xbb, 0x76, 0xbb, 0xc5, 0x5e, 0xec, 0x3e, 0xb5, 0x09, 0x71, 0x77,
+	0x4d, 0xed, 0x0e, 0x4d, 0x29, 0x6b, 0x8c, 0x80, 0xb3, 0xe4, 0xa8, 0xee, 0xcc, 0x69, 0xdc, 0xb7,
+	0x80, 0xea, 0x3b, 0x94, 0xf1, 0x1c, 0x62, 0x0f, 0x8b, 0x8f, 0xe7, 0x9e, 0xdb, 0x08, 0xd8, 0x8f,
+	0x78, 0x89, 0x82, 0x99, 0x1d, 0xfc, 0x88, 0xdf, 0xd8, 0xa9, 0x24, 0x26, 0xe0, 0x4f, 0x4a, 0xe7,
+	0x91, 0xb8, 0xba, 0x86, 0xe2, 0x06, 0x7d, 0x8b, 0x81, 0x85, 0x6e, 0xc6, 0xe6, 0x1e, 0x69, 0x5a,
+	0x48, 0x44, 0x9c, 0x97, 0x5d, 0xc7, 0xd1, 0xca, 0x26, 0xc4, 0xd3, 0x78, 0x65, 0xd3, 0x34, 0x8e,
+	0xab, 0x5f, 0x0a, 0xca, 0x2f, 0x6e, 0xec, 0x09, 0xfd, 0xfe, 0x3a, 0xab, 0xa3, 0xeb, 0x7c, 0x06,
+	0x59, 0xef, 0x7e, 0x88, 0xdd, 0x99, 0xe5, 0x50, 0x57, 0x50, 0x04, 0xe1, 0x37, 0xd9, 0x41, 0x78,
+	0x54, 0x64, 0x53, 0x45, 0x5f, 0xc0, 0x62, 0x40, 0xdf, 0x60, 0x4f, 0x6d, 0x87, 0x7c, 0xef, 0xff,
+	0x6d, 0x3c, 0x2e, 0xeb, 0x17, 0x90, 0x91, 0x1b, 0xd2, 0x4b, 0x28, 0xb9, 0xeb, 0xd6, 0x0d, 0x96,
+	0x73, 0xd5, 0x25, 0x94, 0xb7, 0x6e, 0xf8, 0x4a, 0xb8, 0xdb, 0xbf, 0x01, 0x75, 0x78, 0x03, 0xb2,
+	0x40, 0x16, 0x2f, 0xfa, 0x4e, 0x6c, 0x04, 0xd5, 0x85, 0x7c, 0x74, 0xd3, 0x39, 0xd2, 0xe7, 0x90,
+	0x73, 0xe3, 0x74, 0xe9, 0x16, 0x69, 0x38, 0x0f, 0xb4, 0xb1, 0x52, 0x7d, 0x82, 0xec, 0xd6, 0x0d,
+	0xff, 0x35, 0xf3, 0x1c, 0xf2, 0xd0, 0x39, 0x9a, 0xd6, 0x34, 0x4d, 0xe0, 0xe9, 0x36, 0x56, 0x36,
+	0x85, 0xfc, 0x33, 0x2e, 0xff, 0x0e, 0x00, 0x72, 0x9b, 0xca, 0x61, 0x41, 0x04, 0x00, 0x00,
+}
@@ -0,0 +1,117 @@
+package main
+
+//go:generate protoc --go_out=pb -Ipb pb/incr.proto
+
+import (
+	"incr/pb"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/golang/protobuf/proto"
+)
+
+// wantsProtobuf is true if the client explicitly accepts protobuf responses,
+// or sent a protobuf body without an Accept header. JSON remains the default
+// for browsers and wildcard Accept headers.
+func wantsProtobuf(c *gin.Context) bool {
+	if c.Request.Header.Get("Accept") == "" {
+		return c.ContentType() == binding.MIMEPROTOBUF
+	}
+	return c.NegotiateFormat(binding.MIMEJSON, binding.MIMEPROTOBUF) == binding.MIMEPROTOBUF
+}
+
+// respond renders obj as JSON or msg as protobuf depending on the Accept header.
+func respond(c *gin.Context, code int, obj interface{}, msg func() proto.Message) {
+	if wantsProtobuf(c) {
+		if data, err := proto.Marshal(msg()); err != nil {
+			c.AbortWithError(500, err)
+		} else {
+			c.Data(code, binding.MIMEPROTOBUF, data)
+		}
+	} else {
+		c.JSON(code, obj)
+	}
+}
+
+func eventsFromProto(b *pb.Batch) []Event {
+	events := []Event{}
+	for _, e := range b.GetEvents() {
+		events = append(events, Event{
+			Metric: e.Metric,
+			Type:   Kind(e.Type),
+			Value:  Value(e.Value),
+			Item:   e.Item,
+			Ts:     e.Ts,
+			Labels: e.GetLabels(),
+		})
+	}
+	return events
+}
+
+func metricsToProto(list []Metric, next string) *pb.Metrics {
+	msg := &pb.Metrics{Next: next}
+	for _, m := range list {
+		metric := &pb.Metric{
+			Name:        m.Name,
+			Derived:     m.Derived,
+			Description: m.Description,
+			Unit:        m.Unit,
+			Chart:       m.Chart,
+			Hidden:      m.Hidden,
+		}
+		if m.Atime != nil {
+			metric.Atime = m.Atime.Unix()
+		}
+		if m.Total != nil {
+			metric.Total = float64(*m.Total)
+		}
+		msg.Names = append(msg.Names, m.Name)
+		msg.Metrics = append(msg.Metrics, metric)
+	}
+	return msg
+}
+
+func resultsToProto(results []gin.H) *pb.BatchResult {
+	msg := &pb.BatchResult{}
+	for _, r := range results {
+		res := &pb.Result{Status: r["status"].(string)}
+		if err, ok := r["error"].(string); ok {
+			res.Error = err
+		}
+		msg.Results = append(msg.Results, res)
+	}
+	return msg
+}
+
+func counterToProto(counter *Counter) *pb.Counter {
+	msg := &pb.Counter{Type: string(counter.Kind), Now: counter.Atime.Unix()}
+	for i, bucket := range Buckets {
+		series := &pb.Series{Bucket: bucket.Name}
+		for _, v := range counter.Values[i] {
+			series.Values = append(series.Values, float64(v))
+		}
+		msg.Series = append(msg.Series, series)
+		if counter.Kind == KindTopK {
+			top := &pb.Top{Bucket: bucket.Name}
+			for _, items := range counter.Top(i) {
+				slot := &pb.TopSlot{}
+				for _, item := range items {
+					slot.Items = append(slot.Items, &pb.TopItem{Item: item.Item, Count: item.Count})
+				}
+				top.Slots = append(top.Slots, slot)
+			}
+			msg.Top = append(msg.Top, top)
+		}
+		if counter.Kind != KindTimer {
+			continue
+		}
+		for _, pc := range Percentiles {
+			series := &pb.Series{Bucket: bucket.Name, Stat: pc.Name}
+			for _, v := range counter.Percentiles(i)[pc.Name] {
+				series.Values = append(series.Values, float64(v))
+			}
+			msg.Percentiles = append(msg.Percentiles, series)
+		}
+	}
+	return msg
+}
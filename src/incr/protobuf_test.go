@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"incr/pb"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+)
+
+func newAPI(s Store) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.POST("/api/:ns/:counter", func(c *gin.Context) {
+		if c.Param("counter") == "batch" {
+			batch(c, s)
+		} else {
+			incr(c, s, false)
+		}
+	})
+	e.GET("/api/:ns", func(c *gin.Context) { listMetrics(c, s) })
+	e.GET("/api/:ns/:counter", func(c *gin.Context) { query(c, s) })
+	return e
+}
+
+func serve(e *gin.Engine, method, url, contentType, accept string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	e.ServeHTTP(w, req)
+	return w
+}
+
+func TestProtobufBatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		e := newAPI(s)
+		body, _ := proto.Marshal(&pb.Batch{Events: []*pb.Event{
+			{Metric: "signup", Value: 2},
+			{Metric: "signup", Value: 1, Labels: map[string]string{"plan": "free"}},
+			{Metric: "latency", Type: "ms", Value: 120},
+		}})
+		w := serve(e, "POST", "/api/foo/batch", "application/x-protobuf", "", body)
+		if w.Code != 200 || w.Header().Get("Content-Type") != "application/x-protobuf" {
+			t.Fatal(w.Code, w.Header(), w.Body.String())
+		}
+		res := &pb.BatchResult{}
+		if err := proto.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Results) != 3 || res.Results[0].Status != "ok" {
+			t.Error(res)
+		}
+		if v := total(s, "foo", "signup"); v != 2 {
+			t.Error(v)
+		}
+		if v := total(s, "foo", "signup{plan=free}"); v != 1 {
+			t.Error(v)
+		}
+
+		// Invalid items fail the whole batch
+		body, _ = proto.Marshal(&pb.Batch{Events: []*pb.Event{{Metric: "signup", Value: 1}, {Value: 1}}})
+		w = serve(e, "POST", "/api/foo/batch", "application/x-protobuf", "", body)
+		res = &pb.BatchResult{}
+		if err := proto.Unmarshal(w.Body.Bytes(), res); w.Code != 400 || err != nil {
+			t.Fatal(w.Code, err)
+		}
+		if res.Results[0].Status != "skipped" || res.Results[1].Status != "error" || res.Results[1].Error == "" {
+			t.Error(res)
+		}
+		if v := total(s, "foo", "signup"); v != 2 {
+			t.Error(v)
+		}
+
+		// Protobuf bodies may ask for JSON responses
+		body, _ = proto.Marshal(&pb.Batch{Events: []*pb.Event{{Metric: "signup", Value: 1}}})
+		w = serve(e, "POST", "/api/foo/batch", "application/x-protobuf", "application/json", body)
+		if results := []gin.H{}; json.Unmarshal(w.Body.Bytes(), &results) != nil || len(results) != 1 {
+			t.Error(w.Body.String())
+		}
+
+		// JSON batches go to the same route, which is not a counter
+		w = serve(e, "POST", "/api/foo/batch", "application/json", "", []byte(`[{"metric": "signup", "value": 1}]`))
+		if w.Code != 200 || total(s, "foo", "signup") != 4 {
+			t.Error(w.Code, w.Body.String())
+		}
+		if v := total(s, "foo", "batch"); v != -1 {
+			t.Error(v)
+		}
+		if w := serve(e, "POST", "/api/foo/signup", "", "", nil); w.Code != 200 || total(s, "foo", "signup") != 5 {
+			t.Error(w.Code)
+		}
+		if err := s.Incr("foo", "batch"); err == nil {
+			t.Error("counter named batch")
+		}
+	})
+}
+
+func TestProtobufNegotiation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		e := newAPI(s)
+		s.Incr("foo", "a")
+		s.Incr("foo", "b")
+		s.Apply("foo", []Event{{Metric: "latency", Type: KindTimer, Value: 100}})
+
+		w := serve(e, "GET", "/api/foo?limit=2", "", "application/x-protobuf", nil)
+		metrics := &pb.Metrics{}
+		if err := proto.Unmarshal(w.Body.Bytes(), metrics); w.Code != 200 || err != nil {
+			t.Fatal(w.Code, err)
+		}
+		if len(metrics.Metrics) != 2 || metrics.Metrics[0].Name != "a" || metrics.Next == "" || metrics.Next != w.Header().Get("X-Next-Cursor") {
+			t.Error(metrics)
+		}
+		if len(metrics.Names) != 2 || metrics.Names[1] != "b" {
+			t.Error(metrics.Names)
+		}
+
+		// JSON is the default, also for wildcards
+		for _, accept := range []string{"", "*/*", "application/json", "text/html,application/xhtml+xml,*/*;q=0.8"} {
+			w := serve(e, "GET", "/api/foo", "", accept, nil)
+			list := []Metric{}
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 3 {
+				t.Error(accept, w.Header().Get("Content-Type"), w.Body.String())
+			}
+		}
+
+		w = serve(e, "GET", "/api/foo/latency", "", "application/x-protobuf", nil)
+		counter := &pb.Counter{}
+		if err := proto.Unmarshal(w.Body.Bytes(), counter); w.Code != 200 || err != nil {
+			t.Fatal(w.Code, err)
+		}
+		if counter.Type != "ms" || len(counter.Series) != len(Buckets) || counter.Series[4].Bucket != "total" || counter.Series[4].Values[0] != 1 {
+			t.Error(counter)
+		}
+		if len(counter.Percentiles) == 0 || counter.Percentiles[0].Stat == "" {
+			t.Error(counter.Percentiles)
+		}
+		w = serve(e, "GET", "/api/foo/a", "", "", nil)
+		result := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result["total"] == nil {
+			t.Error(w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+)
+
+var ReplicationBucket = []byte("replication")
+
+var ErrReadOnly = errors.New("read-only follower")
+var errResync = errors.New("follower is out of sync")
+var errRollback = errors.New("rollback")
+
+// ReplLogSize is the number of recent transactions kept for followers to
+// catch up from, followers that are further behind resync from a snapshot.
+var ReplLogSize = 10000
+
+// ReplHeartbeat is how often idle streams are kept alive, a follower drops a
+// stream that was silent for three heartbeats.
+var ReplHeartbeat = 5 * time.Second
+
+// ReplOp is a single change of a replicated transaction: "put", "delete",
+// "create" or "drop" of a bucket, or "seq" when the bucket sequence moved.
+// Path has the names of nested buckets below the top-level Bucket.
+type ReplOp struct {
+	Op     string   `json:"op"`
+	Bucket []byte   `json:"bucket"`
+	Path   [][]byte `json:"path,omitempty"`
+	Key    []byte   `json:"key,omitempty"`
+	Value  []byte   `json:"value,omitempty"`
+	Seq    uint64   `json:"seq,omitempty"`
+}
+
+// ReplTx is a committed write transaction. Transactions are numbered without
+// gaps within an epoch, a random ID given to a database when it is created.
+type ReplTx struct {
+	Seq uint64   `json:"seq"`
+	Ops []ReplOp `json:"ops"`
+}
+
+// Replica is a Backend that records committed write transactions and keeps
+// the recent ones, so that followers can tail them. A follower bootstraps
+// from a snapshot of its leader, applies its transactions and refuses any
+// other writes until it is promoted.
+type Replica struct {
+	Client *http.Client
+	// Token authenticates a follower to the admin API of its leader
+	Token string
+
+	db       Backend
+	mu       sync.Mutex
+	epoch    string
+	seq      uint64
+	opened   uint64
+	log      []ReplTx
+	notify   chan struct{}
+	leader   string
+	promoted chan struct{}
+}
+
+type replTx struct {
+	KVTx
+	ops *[]ReplOp
+}
+
+type replBucket struct {
+	KVBucket
+	path [][]byte
+	ops  *[]ReplOp
+}
+
+// ReplStatus tells the role and position of a node.
+type ReplStatus struct {
+	Role   string `json:"role"`
+	Leader string `json:"leader,omitempty"`
+	Epoch  string `json:"epoch"`
+	Seq    uint64 `json:"seq"`
+}
+
+func NewReplica(db Backend) (*Replica, error) {
+	// Streams and snapshots are long requests, connections are not reused
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	r := &Replica{Client: client, db: db, notify: make(chan struct{})}
+	if err := db.Update(func(tx KVTx) error {
+		b, err := tx.CreateBucketIfNotExists(ReplicationBucket)
+		if err != nil {
+			return err
+		}
+		if epoch := b.Get([]byte("epoch")); epoch != nil {
+			r.epoch = string(epoch)
+		} else {
+			id := make([]byte, 8)
+			if _, err := rand.Read(id); err != nil {
+				return err
+			}
+			r.epoch = hex.EncodeToString(id)
+			if err := b.Put([]byte("epoch"), []byte(r.epoch)); err != nil {
+				return err
+			}
+		}
+		if seq := b.Get([]byte("seq")); seq != nil {
+			r.seq = binary.BigEndian.Uint64(seq)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	r.opened = r.seq
+	return r, nil
+}
+
+func (r *Replica) View(fn func(tx KVTx) error) error {
+	return r.db.View(fn)
+}
+
+// Update records the changes made by fn and numbers the transaction if there
+// are any.
+func (r *Replica) Update(fn func(tx KVTx) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.leader != "" {
+		return ErrReadOnly
+	}
+	t := ReplTx{Seq: r.seq + 1}
+	if err := r.db.Update(func(tx KVTx) error {
+		if err := fn(&replTx{KVTx: tx, ops: &t.Ops}); err != nil || len(t.Ops) == 0 {
+			return err
+		}
+		return putSeq(tx, t.Seq)
+	}); err != nil {
+		return err
+	}
+	if len(t.Ops) > 0 {
+		r.append(t)
+	}
+	return nil
+}
+
+func (r *Replica) Backup(w io.Writer) (int64, error) {
+	return r.db.Backup(w)
+}
+
+func (r *Replica) DeferSync() {
+	if d, ok := r.db.(deferredSync); ok {
+		d.DeferSync()
+	}
+}
+
+func (r *Replica) Sync() error {
+	if d, ok := r.db.(deferredSync); ok {
+		return d.Sync()
+	}
+	return nil
+}
+
+func (r *Replica) Close() error {
+	r.Promote()
+	return r.db.Close()
+}
+
+func putSeq(tx KVTx, seq uint64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return tx.Bucket(ReplicationBucket).Put([]byte("seq"), b)
+}
+
+// append adds a committed transaction to the log and wakes up the streams,
+// mu must be held.
+func (r *Replica) append(t ReplTx) {
+	r.seq = t.Seq
+	r.log = append(r.log, t)
+	if len(r.log) > ReplLogSize {
+		r.log = append([]ReplTx{}, r.log[len(r.log)-ReplLogSize:]...)
+	}
+	close(r.notify)
+	r.notify = make(chan struct{})
+}
+
+// since returns the transactions after seq and a channel that is closed when
+// there are new ones. It fails if they are not in the log any more.
+func (r *Replica) since(epoch string, seq uint64) ([]ReplTx, <-chan struct{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if epoch != r.epoch || seq > r.seq {
+		return nil, nil, false
+	} else if seq == r.seq {
+		return nil, r.notify, true
+	} else if len(r.log) == 0 || r.log[0].Seq > seq+1 {
+		return nil, nil, false
+	}
+	return append([]ReplTx{}, r.log[seq+1-r.log[0].Seq:]...), r.notify, true
+}
+
+func (r *Replica) Status() ReplStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := ReplStatus{Role: "leader", Epoch: r.epoch, Seq: r.seq}
+	if r.leader != "" {
+		status.Role, status.Leader = "follower", r.leader
+	}
+	return status
+}
+
+// Following tells if the node is a follower.
+func (r *Replica) Following() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader != ""
+}
+
+// Follow makes the node a follower of the leader at the given URL until it is
+// promoted.
+func (r *Replica) Follow(leader string) {
+	r.mu.Lock()
+	r.leader = leader
+	r.promoted = make(chan struct{})
+	// Local writes since opening, e.g. migrations, make the position useless
+	if r.seq != r.opened {
+		r.epoch = ""
+	}
+	promoted := r.promoted
+	r.mu.Unlock()
+	go func() {
+		for {
+			err := r.tail(promoted)
+			if err == errResync {
+				log.Println("replication: resync from", leader)
+				err = r.bootstrap()
+			}
+			select {
+			case <-promoted:
+				return
+			default:
+				if err != nil {
+					log.Println("replication:", err)
+					time.Sleep(time.Second)
+				}
+			}
+		}
+	}()
+}
+
+// Promote makes a follower a leader, it starts accepting writes from the
+// position it has reached.
+func (r *Replica) Promote() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.leader != "" {
+		r.leader = ""
+		close(r.promoted)
+	}
+}
+
+// Promoted returns a channel that is closed when a follower is promoted.
+func (r *Replica) Promoted() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.promoted
+}
+
+func (r *Replica) get(path string) (*http.Response, error) {
+	r.mu.Lock()
+	leader := r.leader
+	r.mu.Unlock()
+	req, err := http.NewRequest("GET", leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode == 410 {
+		resp.Body.Close()
+		return nil, errResync
+	} else if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// idleReader closes the stream if nothing was read for a while.
+type idleReader struct {
+	io.ReadCloser
+	timer *time.Timer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.Reset(3 * ReplHeartbeat)
+	return r.ReadCloser.Read(p)
+}
+
+// tail applies the transactions streamed by the leader until the stream
+// breaks or the node is promoted.
+func (r *Replica) tail(promoted <-chan struct{}) error {
+	r.mu.Lock()
+	epoch, seq := r.epoch, r.seq
+	r.mu.Unlock()
+	resp, err := r.get(fmt.Sprintf("/admin/replication/stream?epoch=%s&from=%d", epoch, seq))
+	if err != nil {
+		return err
+	}
+	body := &idleReader{resp.Body, time.AfterFunc(3*ReplHeartbeat, func() { resp.Body.Close() })}
+	defer body.timer.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-promoted:
+		case <-done:
+		}
+		resp.Body.Close()
+	}()
+	dec := json.NewDecoder(body)
+	for {
+		t := ReplTx{}
+		if err := dec.Decode(&t); err != nil {
+			return err
+		} else if err := r.apply(t); err != nil {
+			return err
+		}
+	}
+}
+
+// apply commits a transaction of the leader.
+func (r *Replica) apply(t ReplTx) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.leader == "" {
+		return ErrReadOnly
+	} else if t.Seq <= r.seq {
+		return nil
+	} else if t.Seq != r.seq+1 {
+		return errResync
+	}
+	if err := r.db.Update(func(tx KVTx) error {
+		for _, op := range t.Ops {
+			if err := applyOp(tx, op); err != nil {
+				return err
+			}
+		}
+		return putSeq(tx, t.Seq)
+	}); err != nil {
+		return err
+	}
+	r.append(t)
+	return nil
+}
+
+func applyOp(tx KVTx, op ReplOp) error {
+	if op.Op == "create" || op.Op == "drop" {
+		if len(op.Path) == 0 && op.Op == "create" {
+			_, err := tx.CreateBucketIfNotExists(op.Bucket)
+			return err
+		} else if len(op.Path) == 0 {
+			return tx.DeleteBucket(op.Bucket)
+		}
+		parent := opBucket(tx, op.Bucket, op.Path[:len(op.Path)-1])
+		if parent == nil {
+			return bolt.ErrBucketNotFound
+		} else if name := op.Path[len(op.Path)-1]; op.Op == "create" {
+			_, err := parent.CreateBucketIfNotExists(name)
+			return err
+		} else {
+			return parent.DeleteBucket(name)
+		}
+	}
+	b := opBucket(tx, op.Bucket, op.Path)
+	if b == nil {
+		return bolt.ErrBucketNotFound
+	}
+	switch op.Op {
+	case "put":
+		return b.Put(op.Key, op.Value)
+	case "delete":
+		return b.Delete(op.Key)
+	case "seq":
+		return stepSequence(b, op.Seq)
+	}
+	return fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// opBucket returns the nested bucket at path or nil if there is none.
+func opBucket(tx KVTx, bucket []byte, path [][]byte) KVBucket {
+	b := tx.Bucket(bucket)
+	for _, name := range path {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// stepSequence moves the bucket sequence to seq, bolt has no way to set it.
+func stepSequence(b KVBucket, seq uint64) error {
+	for n := uint64(0); n < seq; {
+		var err error
+		if n, err = b.NextSequence(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBucket copies the records, nested buckets and sequence of src to dst.
+// Bolt has no way to read a sequence, so it is stepped: src must be in a
+// write transaction that is rolled back afterwards.
+func copyBucket(dst, src KVBucket) error {
+	seq, err := src.NextSequence()
+	if err != nil {
+		return err
+	} else if err := stepSequence(dst, seq-1); err != nil {
+		return err
+	}
+	c := src.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil {
+			if err := dst.Put(k, v); err != nil {
+				return err
+			}
+			continue
+		}
+		nested, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		} else if err := copyBucket(nested, src.Bucket(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bootstrap replaces all data with a snapshot of the leader. The snapshot
+// brings the epoch and position of the leader along.
+func (r *Replica) bootstrap() error {
+	resp, err := r.get("/admin/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := ioutil.TempFile("", "incr-replica")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, resp.Body)
+	if err := f.Close(); err != nil {
+		return err
+	} else if err != nil {
+		return err
+	}
+	snapshot, err := OpenBolt(f.Name())
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.db.Update(func(tx KVTx) error {
+		names := [][]byte{}
+		tx.ForEach(func(name []byte, b KVBucket) error {
+			names = append(names, append([]byte{}, name...))
+			return nil
+		})
+		for _, name := range names {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		err := snapshot.Update(func(stx KVTx) error {
+			if err := stx.ForEach(func(name []byte, sb KVBucket) error {
+				b, err := tx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(b, sb)
+			}); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if err == errRollback {
+			err = nil
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	return r.db.View(func(tx KVTx) error {
+		b := tx.Bucket(ReplicationBucket)
+		if b == nil || b.Get([]byte("epoch")) == nil {
+			return errors.New("leader does not support replication")
+		}
+		r.epoch = string(b.Get([]byte("epoch")))
+		r.seq = 0
+		if seq := b.Get([]byte("seq")); seq != nil {
+			r.seq = binary.BigEndian.Uint64(seq)
+		}
+		r.log = nil
+		return nil
+	})
+}
+
+func (tx *replTx) Bucket(name []byte) KVBucket {
+	if b := tx.KVTx.Bucket(name); b != nil {
+		return &replBucket{b, [][]byte{append([]byte{}, name...)}, tx.ops}
+	}
+	return nil
+}
+
+func (tx *replTx) CreateBucketIfNotExists(name []byte) (KVBucket, error) {
+	if b := tx.Bucket(name); b != nil {
+		return b, nil
+	}
+	b, err := tx.KVTx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	name = append([]byte{}, name...)
+	*tx.ops = append(*tx.ops, ReplOp{Op: "create", Bucket: name})
+	return &replBucket{b, [][]byte{name}, tx.ops}, nil
+}
+
+func (tx *replTx) DeleteBucket(name []byte) error {
+	if err := tx.KVTx.DeleteBucket(name); err != nil {
+		return err
+	}
+	*tx.ops = append(*tx.ops, ReplOp{Op: "drop", Bucket: append([]byte{}, name...)})
+	return nil
+}
+
+func (tx *replTx) ForEach(fn func(name []byte, b KVBucket) error) error {
+	return tx.KVTx.ForEach(func(name []byte, b KVBucket) error {
+		return fn(name, &replBucket{b, [][]byte{append([]byte{}, name...)}, tx.ops})
+	})
+}
+
+// op returns an operation on the bucket, or on its nested bucket name.
+func (b *replBucket) op(op string, name []byte) ReplOp {
+	path := b.path[1:]
+	if name != nil {
+		path = append(append([][]byte{}, path...), append([]byte{}, name...))
+	}
+	return ReplOp{Op: op, Bucket: b.path[0], Path: path}
+}
+
+func (b *replBucket) nested(nb KVBucket, name []byte) *replBucket {
+	path := append(append([][]byte{}, b.path...), append([]byte{}, name...))
+	return &replBucket{nb, path, b.ops}
+}
+
+func (b *replBucket) Put(key, value []byte) error {
+	if err := b.KVBucket.Put(key, value); err != nil {
+		return err
+	}
+	op := b.op("put", nil)
+	op.Key, op.Value = append([]byte{}, key...), append([]byte{}, value...)
+	*b.ops = append(*b.ops, op)
+	return nil
+}
+
+func (b *replBucket) Delete(key []byte) error {
+	if err := b.KVBucket.Delete(key); err != nil {
+		return err
+	}
+	op := b.op("delete", nil)
+	op.Key = append([]byte{}, key...)
+	*b.ops = append(*b.ops, op)
+	return nil
+}
+
+func (b *replBucket) NextSequence() (uint64, error) {
+	seq, err := b.KVBucket.NextSequence()
+	if err == nil {
+		op := b.op("seq", nil)
+		op.Seq = seq
+		*b.ops = append(*b.ops, op)
+	}
+	return seq, err
+}
+
+func (b *replBucket) Bucket(name []byte) KVBucket {
+	if nb := b.KVBucket.Bucket(name); nb != nil {
+		return b.nested(nb, name)
+	}
+	return nil
+}
+
+func (b *replBucket) CreateBucketIfNotExists(name []byte) (KVBucket, error) {
+	if nb := b.Bucket(name); nb != nil {
+		return nb, nil
+	}
+	nb, err := b.KVBucket.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	*b.ops = append(*b.ops, b.op("create", name))
+	return b.nested(nb, name), nil
+}
+
+func (b *replBucket) DeleteBucket(name []byte) error {
+	if err := b.KVBucket.DeleteBucket(name); err != nil {
+		return err
+	}
+	*b.ops = append(*b.ops, b.op("drop", name))
+	return nil
+}
+
+// stream sends committed transactions after the given position as JSON
+// lines as they happen. Followers that are too far behind or follow another
+// epoch get 410 and have to resync from a snapshot.
+func stream(c *gin.Context, r *Replica) {
+	epoch := c.Query("epoch")
+	from, _ := strconv.ParseUint(c.Query("from"), 10, 64)
+	txs, notify, ok := r.since(epoch, from)
+	if !ok {
+		c.AbortWithStatus(410)
+		return
+	}
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Writer.WriteHeaderNow()
+	enc := json.NewEncoder(c.Writer)
+	heartbeat := time.NewTicker(ReplHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		for _, t := range txs {
+			if err := enc.Encode(t); err != nil {
+				return
+			}
+			from = t.Seq
+		}
+		c.Writer.Flush()
+		select {
+		case <-notify:
+		case <-heartbeat.C:
+			if _, err := c.Writer.Write([]byte("\n")); err != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+		if txs, notify, ok = r.since(epoch, from); !ok {
+			return
+		}
+	}
+}
+
+// readOnlyHandler rejects writes while the node is a follower.
+func readOnlyHandler(r *Replica) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		write := (c.Request.Method != "GET" && c.Request.Method != "HEAD" && c.Request.Method != "OPTIONS") ||
+			strings.HasSuffix(c.Request.URL.Path, ".gif")
+		if write && c.Request.URL.Path != "/admin/replication/promote" && r.Following() {
+			c.AbortWithError(503, ErrReadOnly)
+		} else {
+			c.Next()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newReplicaStore(t *testing.T) (*Replica, Store) {
+	db, _ := OpenMem("")
+	r, err := NewReplica(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStoreOn(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, s
+}
+
+func replicationServer(r *Replica, s Store) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	e := gin.New()
+	e.GET("/admin/backup", func(c *gin.Context) {
+		backup(c, s)
+	})
+	e.GET("/admin/replication/stream", func(c *gin.Context) {
+		stream(c, r)
+	})
+	return httptest.NewServer(e)
+}
+
+// eventually polls the condition for a while, replication is asynchronous.
+func eventually(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("condition not met")
+}
+
+func total(s Store, ns, name string) Value {
+	if c, err := s.Query(ns, name); err == nil {
+		return c.Values[BucketIndex("total")][0]
+	}
+	return -1
+}
+
+func TestReplication(t *testing.T) {
+	seconds = 0
+	leader, ls := newReplicaStore(t)
+	ls.Incr("foo", "bar")
+	ls.PutRule(&Rule{NS: "foo", Name: "a", Expr: "bar.day slot 0 > 1"})
+	srv := replicationServer(leader, ls)
+	defer srv.Close()
+
+	// A new follower bootstraps from a snapshot, then tails the leader
+	follower, fs := newReplicaStore(t)
+	defer follower.Promote()
+	follower.Follow(srv.URL)
+	eventually(t, func() bool { return total(fs, "foo", "bar") == 1 })
+	ls.Incr("foo", "bar")
+	ls.Apply("foo", []Event{{Metric: "baz", Value: 5}})
+	ls.PutDerived("foo", "qux", "bar + baz")
+	eventually(t, func() bool { return total(fs, "foo", "qux") == 7 })
+	if status := follower.Status(); status.Role != "follower" || status != (ReplStatus{
+		Role: "follower", Leader: srv.URL, Epoch: leader.Status().Epoch, Seq: leader.Status().Seq}) {
+		t.Error(status, leader.Status())
+	}
+
+	// Followers are read-only
+	if err := fs.Incr("foo", "bar"); err != ErrReadOnly {
+		t.Error(err)
+	}
+
+	// A promoted follower takes writes and continues rule IDs
+	follower.Promote()
+	if err := fs.Incr("foo", "bar"); err != nil {
+		t.Error(err)
+	}
+	r := &Rule{NS: "foo", Name: "b", Expr: "bar.day slot 0 > 1"}
+	fs.PutRule(r)
+	if r.ID != "2" {
+		t.Error(r.ID)
+	}
+	ls.Incr("foo", "bar")
+	time.Sleep(50 * time.Millisecond)
+	if v := total(fs, "foo", "bar"); v != 3 {
+		t.Error(v)
+	}
+}
+
+func TestReplicationResync(t *testing.T) {
+	seconds = 0
+	defer func(size int) { ReplLogSize = size }(ReplLogSize)
+	ReplLogSize = 2
+	leader, ls := newReplicaStore(t)
+	srv := replicationServer(leader, ls)
+	defer srv.Close()
+
+	follower, fs := newReplicaStore(t)
+	defer follower.Promote()
+	fs.Incr("foo", "local")
+	follower.Follow(srv.URL)
+	ls.Incr("foo", "bar")
+	eventually(t, func() bool { return total(fs, "foo", "bar") == 1 })
+	// Local data is replaced by the snapshot of the leader
+	if _, err := fs.Query("foo", "local"); err != ErrNotFound {
+		t.Error(err)
+	}
+
+	// A follower that fell behind the log resyncs
+	follower.Promote()
+	for i := 0; i < 5; i++ {
+		ls.Incr("foo", "bar")
+	}
+	follower.Follow(srv.URL)
+	eventually(t, func() bool { return total(fs, "foo", "bar") == 6 })
+}
@@ -4,29 +4,61 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"io"
 	"math"
+	"sort"
+	"strconv"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
-type Number float32
+type Number float64
 
 var ErrLimit = errors.New("limit exceeded")
 var ErrNotFound = errors.New("not found")
+var ErrExists = errors.New("already exists")
+var ErrZone = errors.New("time zone mismatch")
 
 var Now = time.Now
 
 var IncrBucket = []byte("incr")
+var AlertsBucket = []byte("alerts")
+var DerivedBucket = []byte("derived")
+var NamespacesBucket = []byte("namespaces")
+var MetaBucket = []byte("meta")
+
+// NamespaceBuckets keep a nested bucket for every namespace.
+var NamespaceBuckets = [][]byte{IncrBucket, DerivedBucket, AlertsBucket, MetaBucket}
 
 type Store interface {
 	Incr(ns, name string) error
-	List(ns string) ([]string, error)
+	Apply(ns string, events []Event) error
+	List(ns string) ([]Metric, error)
+	ListPage(ns string, q *ListQuery) ([]Metric, string, error)
 	Query(ns, name string) (*Counter, error)
+	Walk(ns string, fn func(name string, c *Counter) error) error
+	Backup(w io.Writer) (int64, error)
+	Import(ns string, counters map[string]*Counter) error
+	Rules(ns string) ([]*Rule, error)
+	PutRule(r *Rule) error
+	PutRuleState(r *Rule) error
+	DeleteRule(ns, id string) error
+	Derived(ns string) (map[string]string, error)
+	PutDerived(ns, name, expr string) error
+	DeleteDerived(ns, name string) error
+	Meta(ns, name string) (*MetricMeta, error)
+	PutMeta(ns, name string, meta *MetricMeta) error
+	Namespace(ns string) (*Namespace, error)
+	Namespaces() ([]*Namespace, error)
+	CreateNamespace(n *Namespace) error
+	PutNamespace(n *Namespace) error
+	DeleteNamespace(ns string) error
+	Expire(ns string, dryRun bool) (*Expiry, error)
 }
 
+// store keeps counters, rules and settings in buckets of a Backend.
 type store struct {
-	db *bolt.DB
+	db Backend
 }
 
 type Bucket struct {
@@ -61,101 +93,956 @@ func BucketIndex(bucket string) int {
 }
 
 type Counter struct {
+	Kind   Kind
 	Atime  time.Time
 	Values [][]Value
+	// Counts are exact values of counting kinds, Values mirror them as floats
+	Counts [][]int64
+	// Hists are value distributions of every slot, kept for timers only
+	Hists [][]Histogram
+	// TopK are the most frequent items of every slot, kept for top-K only
+	TopK [][]TopK
+	// Align is how slots line up with the clock, unless there is a time zone
+	Align Align
+	// Hours are the hourly values of the last week, a longer history of the
+	// day bucket for hour-of-day comparison
+	Hours []Value
+	// Created is the time of the first value, zero for counters stored before
+	// it was kept
+	Created time.Time
+
+	loc *time.Location
 }
 
 type Value Number
 
+// HourHistory is the number of hourly slots kept in Counter.Hours.
+const HourHistory = 7 * 24
+
+// Metric is an entry of the namespace listing. Derived metrics are computed
+// from other metrics at query time.
+type Metric struct {
+	Name    string `json:"name"`
+	Derived bool   `json:"derived,omitempty"`
+	// Atime and Total are only read when the listing is sorted by them
+	Atime *time.Time `json:"atime,omitempty"`
+	Total *Value     `json:"total,omitempty"`
+	MetricMeta
+}
+
+// NewStore opens a bolt database file.
 func NewStore(path string) (Store, error) {
-	if db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second}); err != nil {
+	db, err := OpenBolt(path)
+	if err != nil {
 		return nil, err
-	} else if err := db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists(IncrBucket)
-		return err
+	}
+	return NewStoreOn(db)
+}
+
+// NewStoreOn creates the buckets in the backend and upgrades records written
+// by older versions.
+func NewStoreOn(db Backend) (Store, error) {
+	if err := db.Update(func(tx KVTx) error {
+		for _, b := range append([][]byte{NamespacesBucket}, NamespaceBuckets...) {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
 	}); err != nil {
+		db.Close()
+		return nil, err
+	} else if err := migrate(db); err != nil {
+		db.Close()
 		return nil, err
-	} else {
-		return &store{db: db}, nil
 	}
+	return &store{db: db}, nil
 }
 
 func (s *store) Incr(ns, name string) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(IncrBucket)
-		cnt := NewCounter(b.Get([]byte(ns + ":" + name)))
+	if ReservedNames[name] {
+		return ErrReserved
+	}
+	return s.db.Update(func(tx KVTx) error {
+		if getter(nsBucket(tx, DerivedBucket, ns))([]byte(name)) != nil {
+			return ErrDerived
+		}
+		b, err := createNSBucket(tx, IncrBucket, ns)
+		if err != nil {
+			return err
+		}
+		cnt := NewCounterIn(b.Get([]byte(name)), location(tx, ns))
 		cnt.Incr()
-		return b.Put([]byte(ns+":"+name), cnt.Bytes())
+		return b.Put([]byte(name), cnt.Bytes())
 	})
 }
 
-func (s *store) List(ns string) ([]string, error) {
-	list := []string{}
-	err := s.db.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket(IncrBucket).Cursor()
-		prefix := []byte(ns + ":")
-		for k, _ := c.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = c.Next() {
-			list = append(list, string(bytes.TrimPrefix(k, prefix)))
+func (s *store) Apply(ns string, events []Event) error {
+	return s.db.Update(func(tx KVTx) error {
+		b, err := createNSBucket(tx, IncrBucket, ns)
+		if err != nil {
+			return err
+		}
+		counters, err := apply(b.Get, getter(nsBucket(tx, DerivedBucket, ns)), events, location(tx, ns))
+		if err != nil {
+			return err
+		}
+		for name, cnt := range counters {
+			if err := b.Put([]byte(name), cnt.Bytes()); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
+}
+
+// apply adds the events to the counters read with get and returns the
+// updated counters by name. Stores write them back only if there is no error.
+// Events can't create counters named like derived metrics read with derived,
+// which would shadow them.
+func apply(get, derived func(key []byte) []byte, events []Event, loc *time.Location) (map[string]*Counter, error) {
+	counters := map[string]*Counter{}
+	for i, e := range events {
+		if err := e.Validate(); err != nil {
+			return nil, &ItemError{i, err}
+		}
+		name := e.Name()
+		if derived([]byte(name)) != nil {
+			return nil, &ItemError{i, ErrDerived}
+		}
+		cnt, ok := counters[name]
+		if !ok {
+			data := get([]byte(name))
+			cnt = NewCounterIn(data, loc)
+			if data == nil {
+				cnt.Kind = e.Kind()
+			}
+			counters[name] = cnt
+		}
+		if cnt.Kind != e.Kind() {
+			return nil, &ItemError{i, ErrKind}
+		}
+		if cnt.Kind == KindTopK {
+			cnt.AddItem(e.Time(), e.Item)
+		} else {
+			cnt.Add(e.Time(), e.Value)
+		}
+	}
+	return counters, nil
+}
+
+// List returns metrics of the namespace sorted by name, derived ones included.
+func (s *store) List(ns string) ([]Metric, error) {
+	list, _, err := s.ListPage(ns, &ListQuery{})
 	return list, err
 }
 
 func (s *store) Query(ns, name string) (counter *Counter, err error) {
-	err = s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(IncrBucket)
-		data := b.Get([]byte(ns + ":" + name))
+	err = s.db.View(func(tx KVTx) error {
+		get := getter(nsBucket(tx, IncrBucket, ns))
+		data := get([]byte(name))
 		if data == nil {
+			if expr := getter(nsBucket(tx, DerivedBucket, ns))([]byte(name)); expr != nil {
+				counter, err = derive(get, string(expr), location(tx, ns))
+				return err
+			}
 			return ErrNotFound
 		}
-		counter = NewCounter(data)
+		counter = NewCounterIn(data, location(tx, ns))
 		return nil
 	})
 	return counter, err
 }
 
+// derive evaluates a derived metric expression over the counters read with
+// get.
+func derive(get func(key []byte) []byte, expr string, loc *time.Location) (*Counter, error) {
+	e, err := ParseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	counters := map[string]*Counter{}
+	c := NewCounterIn(nil, loc)
+	for _, name := range e.Metrics(nil) {
+		if data := get([]byte(name)); data != nil {
+			counters[name] = NewCounterIn(data, loc)
+			if created := counters[name].Created; created.IsZero() || created.Before(c.Created) {
+				c.Created = created
+			}
+		}
+	}
+	// Expressions are evaluated over the buckets only, derived metrics have
+	// no hourly history
+	c.Kind = KindDerived
+	c.Values = e.Eval(counters)
+	c.Hours = nil
+	return c, nil
+}
+
+// WalkBatch is the number of counters Walk reads in one transaction.
+var WalkBatch = 100
+
+// Walk calls fn for every counter in the namespace in key order. Counters are
+// read WalkBatch at a time in short read transactions and fn is called
+// between them, so a slow fn, e.g. writing to a client, doesn't hold up
+// writes. Counters written during the walk may or may not be seen.
+func (s *store) Walk(ns string, fn func(name string, c *Counter) error) error {
+	type entry struct {
+		name string
+		c    *Counter
+	}
+	var next []byte
+	for {
+		page := []entry{}
+		if err := s.db.View(func(tx KVTx) error {
+			b := nsBucket(tx, IncrBucket, ns)
+			if b == nil {
+				return nil
+			}
+			cur := b.Cursor()
+			loc := location(tx, ns)
+			k, v := cur.First()
+			if next != nil {
+				k, v = cur.Seek(next)
+			}
+			for ; k != nil && len(page) < WalkBatch; k, v = cur.Next() {
+				page = append(page, entry{string(k), NewCounterIn(v, loc)})
+			}
+			next = nil
+			if k != nil {
+				next = append([]byte{}, k...)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, e := range page {
+			if err := fn(e.name, e.c); err != nil {
+				return err
+			}
+		}
+		if next == nil {
+			return nil
+		}
+	}
+}
+
+// Backup writes a consistent snapshot of the whole database to w while
+// writes keep going.
+func (s *store) Backup(w io.Writer) (int64, error) {
+	return s.db.Backup(w)
+}
+
+// Import merges the counters into the namespace in a single transaction.
+func (s *store) Import(ns string, counters map[string]*Counter) error {
+	return s.db.Update(func(tx KVTx) error {
+		b, err := createNSBucket(tx, IncrBucket, ns)
+		if err != nil {
+			return err
+		}
+		merged, err := merge(b.Get, getter(nsBucket(tx, DerivedBucket, ns)), counters, location(tx, ns))
+		if err != nil {
+			return err
+		}
+		for name, c := range merged {
+			if err := b.Put([]byte(name), c.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// merge merges the counters into the ones read with get. Counters must have
+// the time zone loc, slots of another calendar don't line up, and can't be
+// named like derived metrics read with derived.
+func merge(get, derived func(key []byte) []byte, counters map[string]*Counter, loc *time.Location) (map[string]*Counter, error) {
+	merged := map[string]*Counter{}
+	for name, c := range counters {
+		if derived([]byte(name)) != nil {
+			return nil, ErrDerived
+		}
+		if zoneName(c.loc) != zoneName(loc) {
+			return nil, fmt.Errorf("%v: %s has %q, not %q", ErrZone, name, zoneName(c.loc), zoneName(loc))
+		}
+		if data := get([]byte(name)); data != nil {
+			cnt := NewCounterIn(data, loc)
+			if err := cnt.Merge(c); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			c = cnt
+		}
+		merged[name] = c
+	}
+	return merged, nil
+}
+
+// Rules returns alert rules of the namespace, or of all namespaces if ns is
+// empty.
+func (s *store) Rules(ns string) ([]*Rule, error) {
+	rules := []*Rule{}
+	err := s.db.View(func(tx KVTx) error {
+		buckets := []KVBucket{nsBucket(tx, AlertsBucket, ns)}
+		if ns == "" {
+			buckets = nil
+			c := tx.Bucket(AlertsBucket).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				buckets = append(buckets, tx.Bucket(AlertsBucket).Bucket(k))
+			}
+		}
+		for _, b := range buckets {
+			if b == nil {
+				continue
+			}
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				r := &Rule{}
+				if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(r); err != nil {
+					return err
+				}
+				rules = append(rules, r)
+			}
+		}
+		return nil
+	})
+	return rules, err
+}
+
+// PutRule saves the rule, a new ID is assigned if the rule has none. IDs are
+// unique across namespaces.
+func (s *store) PutRule(r *Rule) error {
+	return s.db.Update(func(tx KVTx) error {
+		if r.ID == "" {
+			id, err := tx.Bucket(AlertsBucket).NextSequence()
+			if err != nil {
+				return err
+			}
+			r.ID = strconv.FormatUint(id, 10)
+		}
+		buf := &bytes.Buffer{}
+		if err := gob.NewEncoder(buf).Encode(r); err != nil {
+			return err
+		}
+		b, err := createNSBucket(tx, AlertsBucket, r.NS)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(r.ID), buf.Bytes())
+	})
+}
+
+// PutRuleState saves the state, the time it changed and the value of the
+// rule. Unlike PutRule it keeps other fields as stored and returns
+// ErrNotFound if the rule or its namespace was deleted meanwhile, instead of
+// creating them again.
+func (s *store) PutRuleState(r *Rule) error {
+	return s.db.Update(func(tx KVTx) error {
+		b := nsBucket(tx, AlertsBucket, r.NS)
+		data := getter(b)([]byte(r.ID))
+		if data == nil {
+			return ErrNotFound
+		}
+		stored := &Rule{}
+		if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(stored); err != nil {
+			return err
+		}
+		stored.State, stored.Since, stored.Value = r.State, r.Since, r.Value
+		buf := &bytes.Buffer{}
+		if err := gob.NewEncoder(buf).Encode(stored); err != nil {
+			return err
+		}
+		return b.Put([]byte(r.ID), buf.Bytes())
+	})
+}
+
+func (s *store) DeleteRule(ns, id string) error {
+	return s.db.Update(func(tx KVTx) error {
+		b := nsBucket(tx, AlertsBucket, ns)
+		if b == nil || b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// Derived returns expressions of derived metrics in the namespace by name.
+func (s *store) Derived(ns string) (map[string]string, error) {
+	derived := map[string]string{}
+	err := s.db.View(func(tx KVTx) error {
+		b := nsBucket(tx, DerivedBucket, ns)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			derived[string(k)] = string(v)
+		}
+		return nil
+	})
+	return derived, err
+}
+
+// PutDerived defines or redefines a derived metric. It can not shadow a
+// metric that has data, and metrics with its name can't get data later.
+func (s *store) PutDerived(ns, name, expr string) error {
+	if ReservedNames[name] {
+		return ErrReserved
+	}
+	if _, err := ParseExpr(expr); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx KVTx) error {
+		if getter(nsBucket(tx, IncrBucket, ns))([]byte(name)) != nil {
+			return ErrExists
+		}
+		b, err := createNSBucket(tx, DerivedBucket, ns)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), []byte(expr))
+	})
+}
+
+func (s *store) DeleteDerived(ns, name string) error {
+	return s.db.Update(func(tx KVTx) error {
+		b := nsBucket(tx, DerivedBucket, ns)
+		if b == nil || b.Get([]byte(name)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// Meta returns metadata of the metric, empty if there is none.
+func (s *store) Meta(ns, name string) (meta *MetricMeta, err error) {
+	meta = &MetricMeta{}
+	err = s.db.View(func(tx KVTx) error {
+		if data := getter(nsBucket(tx, MetaBucket, ns))([]byte(name)); data != nil {
+			return gob.NewDecoder(bytes.NewBuffer(data)).Decode(meta)
+		}
+		return nil
+	})
+	return meta, err
+}
+
+// PutMeta replaces metadata of the metric, empty metadata is removed. The
+// metric doesn't need to have data yet.
+func (s *store) PutMeta(ns, name string, meta *MetricMeta) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx KVTx) error {
+		if *meta == (MetricMeta{}) {
+			if b := nsBucket(tx, MetaBucket, ns); b != nil {
+				return b.Delete([]byte(name))
+			}
+			return nil
+		}
+		buf := &bytes.Buffer{}
+		if err := gob.NewEncoder(buf).Encode(meta); err != nil {
+			return err
+		}
+		b, err := createNSBucket(tx, MetaBucket, ns)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), buf.Bytes())
+	})
+}
+
+// Namespace returns settings of the namespace, defaults if there are none.
+func (s *store) Namespace(ns string) (n *Namespace, err error) {
+	err = s.db.View(func(tx KVTx) error {
+		if n, err = readNamespace(tx, ns); err == nil {
+			n.Metrics = countMetrics(tx, ns)
+		}
+		return err
+	})
+	return n, err
+}
+
+// Namespaces returns all namespaces sorted by name, including the ones that
+// have records but were never registered, e.g. of older versions.
+func (s *store) Namespaces() ([]*Namespace, error) {
+	list := []*Namespace{}
+	err := s.db.View(func(tx KVTx) error {
+		names := map[string]bool{}
+		for _, bucket := range append([][]byte{NamespacesBucket}, NamespaceBuckets...) {
+			c := tx.Bucket(bucket).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				names[string(k)] = true
+			}
+		}
+		sorted := []string{}
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			n, err := readNamespace(tx, name)
+			if err != nil {
+				return err
+			}
+			n.Metrics = countMetrics(tx, name)
+			list = append(list, n)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// CreateNamespace registers a new namespace, it fails with ErrExists if the
+// namespace is registered or has records.
+func (s *store) CreateNamespace(n *Namespace) error {
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx KVTx) error {
+		if tx.Bucket(NamespacesBucket).Get([]byte(n.Name)) != nil {
+			return ErrExists
+		}
+		for _, bucket := range NamespaceBuckets {
+			if nsBucket(tx, bucket, n.Name) != nil {
+				return ErrExists
+			}
+		}
+		n.Created = Now()
+		return writeNamespace(tx, n)
+	})
+}
+
+// PutNamespace updates settings of the namespace, registering it if needed.
+// The creation time can't be changed, nor the time zone once the namespace
+// has counters.
+func (s *store) PutNamespace(n *Namespace) error {
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx KVTx) error {
+		n.Created = Now()
+		old, err := readNamespace(tx, n.Name)
+		if err != nil {
+			return err
+		} else if !old.Created.IsZero() {
+			n.Created = old.Created
+		}
+		// Counters are slotted by the calendar of the zone
+		if n.TimeZone != old.TimeZone && countMetrics(tx, n.Name) > 0 {
+			return ErrTimeZone
+		}
+		return writeNamespace(tx, n)
+	})
+}
+
+// DeleteNamespace removes the namespace with its settings, counters, derived
+// metrics, alert rules and metric metadata.
+func (s *store) DeleteNamespace(ns string) error {
+	return s.db.Update(func(tx KVTx) error {
+		found := tx.Bucket(NamespacesBucket).Get([]byte(ns)) != nil
+		for _, bucket := range NamespaceBuckets {
+			if nsBucket(tx, bucket, ns) != nil {
+				found = true
+				if err := tx.Bucket(bucket).DeleteBucket([]byte(ns)); err != nil {
+					return err
+				}
+			}
+		}
+		if !found {
+			return ErrNotFound
+		}
+		return tx.Bucket(NamespacesBucket).Delete([]byte(ns))
+	})
+}
+
+func writeNamespace(tx KVTx, n *Namespace) error {
+	buf := &bytes.Buffer{}
+	stored := *n
+	stored.Metrics = 0
+	if err := gob.NewEncoder(buf).Encode(&stored); err != nil {
+		return err
+	}
+	return tx.Bucket(NamespacesBucket).Put([]byte(n.Name), buf.Bytes())
+}
+
+// countMetrics returns the number of counters of the namespace without
+// reading them.
+func countMetrics(tx KVTx, ns string) int {
+	if b := nsBucket(tx, IncrBucket, ns); b != nil {
+		return b.KeyN()
+	}
+	return 0
+}
+
+func readNamespace(tx KVTx, ns string) (*Namespace, error) {
+	n := &Namespace{Name: ns}
+	if data := tx.Bucket(NamespacesBucket).Get([]byte(ns)); data != nil {
+		if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(n); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Counters, derived metrics, alert rules and metric metadata of a namespace
+// are kept in a bucket named after it, nested in each of NamespaceBuckets.
+// nsBucket returns nil if the namespace has no records there yet.
+func nsBucket(tx KVTx, bucket []byte, ns string) KVBucket {
+	return tx.Bucket(bucket).Bucket([]byte(ns))
+}
+
+// createNSBucket also registers the namespace when it gets its first record.
+func createNSBucket(tx KVTx, bucket []byte, ns string) (KVBucket, error) {
+	if b := nsBucket(tx, bucket, ns); b != nil {
+		return b, nil
+	} else if ns == "" {
+		return nil, ErrName
+	}
+	if tx.Bucket(NamespacesBucket).Get([]byte(ns)) == nil {
+		if err := writeNamespace(tx, &Namespace{Name: ns, Created: Now()}); err != nil {
+			return nil, err
+		}
+	}
+	return tx.Bucket(bucket).CreateBucketIfNotExists([]byte(ns))
+}
+
+// getter reads records of a bucket that may not exist.
+func getter(b KVBucket) func(key []byte) []byte {
+	if b == nil {
+		return func(key []byte) []byte { return nil }
+	}
+	return b.Get
+}
+
+// location returns the time zone of the namespace or nil if it has none.
+func location(tx KVTx, ns string) *time.Location {
+	if n, err := readNamespace(tx, ns); err == nil {
+		return n.Location()
+	}
+	return nil
+}
+
+// zoneName returns the name of the time zone, empty for fixed periods.
+func zoneName(loc *time.Location) string {
+	if loc == nil {
+		return ""
+	}
+	return loc.String()
+}
+
 func NewCounter(data []byte) *Counter {
-	c := Counter{}
+	return NewCounterIn(data, nil)
+}
+
+// NewCounterIn decodes a counter aligned to the calendar of loc, or to the
+// fixed bucket periods if loc is nil, and rolls it to the current time.
+func NewCounterIn(data []byte, loc *time.Location) *Counter {
+	c := Counter{loc: loc}
 	if data != nil {
 		b := bytes.NewBuffer(data)
 		gob.NewDecoder(b).Decode(&c)
 	} else {
 		c.Atime = Now()
+		c.Created = c.Atime
+		c.Align = Alignment
 		c.Values = [][]Value{}
 		for _, bucket := range Buckets {
 			c.Values = append(c.Values, make([]Value, bucket.Size))
 		}
 	}
 
+	if c.Kind == "" {
+		c.Kind = KindCounter
+	}
+	if data != nil {
+		c.initCounts()
+	}
+	c.initHours()
+
+	c.Roll(Now())
+	return &c
+}
+
+// Roll moves the counter to time t, shifting the values so that slot 0 of
+// every bucket is the slot t falls into.
+func (c *Counter) Roll(t time.Time) {
 	// Change atime
 	atime := c.Atime
-	c.Atime = Now()
+	c.Atime = t
 
 	// Roll values
 	for i, bucket := range Buckets {
-		roll := int((c.Atime.Round(bucket.Period).Sub(atime.Round(bucket.Period))) / bucket.Period)
+		roll := c.periods(i, atime, c.Atime)
 		if roll > 0 {
 			if roll >= bucket.Size {
 				c.Values[i] = make([]Value, bucket.Size)
 			} else {
 				c.Values[i] = append(make([]Value, roll), c.Values[i]...)[:bucket.Size]
 			}
+			if c.Counts != nil {
+				if roll >= bucket.Size {
+					c.Counts[i] = make([]int64, bucket.Size)
+				} else {
+					c.Counts[i] = append(make([]int64, roll), c.Counts[i]...)[:bucket.Size]
+				}
+			}
+			if c.Hists != nil {
+				if roll >= bucket.Size {
+					c.Hists[i] = make([]Histogram, bucket.Size)
+				} else {
+					c.Hists[i] = append(make([]Histogram, roll), c.Hists[i]...)[:bucket.Size]
+				}
+			}
+			if c.TopK != nil {
+				if roll >= bucket.Size {
+					c.TopK[i] = make([]TopK, bucket.Size)
+				} else {
+					c.TopK[i] = append(make([]TopK, roll), c.TopK[i]...)[:bucket.Size]
+				}
+			}
 		}
 	}
+	if roll := c.periods(BucketIndex("day"), atime, c.Atime); roll > 0 && c.Hours != nil {
+		if roll >= HourHistory {
+			c.Hours = make([]Value, HourHistory)
+		} else {
+			c.Hours = append(make([]Value, roll), c.Hours...)[:HourHistory]
+		}
+	}
+}
 
-	return &c
+// Merge adds the values of another counter of the same kind to c. Both are
+// relabelled and rolled to the later of their times first, so slots line up.
+// For gauges the more recent counter wins.
+func (c *Counter) Merge(o *Counter) error {
+	if c.Kind != o.Kind {
+		return ErrKind
+	}
+	t := c.Atime
+	if o.Atime.After(t) {
+		t = o.Atime
+	}
+	newer := o.Atime.After(c.Atime)
+	o.Relabel(c.Align)
+	c.initCounts()
+	o.initCounts()
+	c.Roll(t)
+	o.Roll(t)
+	for i := range Buckets {
+		for slot, v := range o.Values[i] {
+			if c.counting() {
+				c.Counts[i][slot] += o.Counts[i][slot]
+				c.Values[i][slot] = Value(c.Counts[i][slot])
+			} else if (newer && v != 0) || c.Values[i][slot] == 0 {
+				c.Values[i][slot] = v
+			}
+		}
+	}
+	if o.Hists != nil {
+		c.initHists()
+		for i := range Buckets {
+			for slot := range o.Hists[i] {
+				c.Hists[i][slot].Merge(o.Hists[i][slot])
+			}
+		}
+	}
+	if o.TopK != nil {
+		c.initTopK()
+		for i := range Buckets {
+			for slot := range o.TopK[i] {
+				c.TopK[i][slot].Merge(o.TopK[i][slot])
+			}
+		}
+	}
+	c.initHours()
+	o.initHours()
+	for slot, v := range o.Hours {
+		if c.counting() {
+			c.Hours[slot] += v
+		} else if (newer && v != 0) || c.Hours[slot] == 0 {
+			c.Hours[slot] = v
+		}
+	}
+	if o.Created.IsZero() || o.Created.Before(c.Created) {
+		c.Created = o.Created
+	}
+	return nil
+}
+
+func (c *Counter) initHists() {
+	if c.Hists == nil {
+		for _, bucket := range Buckets {
+			c.Hists = append(c.Hists, make([]Histogram, bucket.Size))
+		}
+	}
+}
+
+func (c *Counter) initTopK() {
+	if c.TopK == nil {
+		for _, bucket := range Buckets {
+			c.TopK = append(c.TopK, make([]TopK, bucket.Size))
+		}
+	}
+}
+
+// initHours starts the hourly history of counters stored before it was kept
+// with the hourly slots of the day bucket.
+func (c *Counter) initHours() {
+	if c.Hours == nil {
+		c.Hours = make([]Value, HourHistory)
+		copy(c.Hours, c.Values[BucketIndex("day")])
+	}
+}
+
+// addHour puts a value submitted at time t into the hourly history. Like the
+// buckets it is summed for counting kinds, gauges keep the last value.
+func (c *Counter) addHour(t time.Time, v Value) {
+	c.initHours()
+	if slot := c.slot(BucketIndex("day"), t); slot >= 0 && slot < HourHistory {
+		if c.Kind == KindGauge {
+			c.Hours[slot] = v
+		} else {
+			c.Hours[slot] += v
+		}
+	}
+}
+
+// observe moves the creation time back to t if a value is submitted for an
+// earlier time.
+func (c *Counter) observe(t time.Time) {
+	if t.Before(c.Created) {
+		c.Created = t
+	}
+}
+
+// counting tells if the values of the counter are exact counts rather than
+// measurements.
+func (c *Counter) counting() bool {
+	return c.Kind != KindGauge && c.Kind != KindDerived
+}
+
+// initCounts keeps exact counts for counting kinds. Counters stored before
+// counts were kept are converted from their float values, counters decoded
+// without values get them from the counts.
+func (c *Counter) initCounts() {
+	if !c.counting() {
+		return
+	}
+	if c.Counts == nil {
+		for i, bucket := range Buckets {
+			counts := make([]int64, bucket.Size)
+			for slot := range counts {
+				if slot < len(c.Values[i]) {
+					counts[slot] = int64(math.Round(float64(c.Values[i][slot])))
+				}
+			}
+			c.Counts = append(c.Counts, counts)
+		}
+	}
+	if c.Values == nil {
+		for i := range Buckets {
+			values := make([]Value, len(c.Counts[i]))
+			for slot, n := range c.Counts[i] {
+				values[slot] = Value(n)
+			}
+			c.Values = append(c.Values, values)
+		}
+	}
+}
+
+// count adds n to a slot of a counting kind.
+func (c *Counter) count(i, slot int, n int64) {
+	c.Counts[i][slot] += n
+	c.Values[i][slot] = Value(c.Counts[i][slot])
 }
 
 func (c *Counter) Incr() {
+	c.initCounts()
 	for i, _ := range Buckets {
-		c.Values[i][0]++
+		c.count(i, 0, 1)
 	}
+	c.addHour(c.Atime, 1)
 }
 
+// Add puts a value submitted at time t into every bucket that still keeps the
+// slot for t. Counters are summed, gauges keep the last value and timers
+// count the values and keep their distribution.
+func (c *Counter) Add(t time.Time, v Value) {
+	if c.Kind == KindTimer {
+		c.initHists()
+	}
+	c.initCounts()
+	for i, bucket := range Buckets {
+		slot := c.slot(i, t)
+		if slot < 0 || slot >= bucket.Size {
+			continue
+		}
+		switch c.Kind {
+		case KindGauge:
+			c.Values[i][slot] = v
+		case KindTimer:
+			c.count(i, slot, 1)
+			c.Hists[i][slot].Add(v)
+		default:
+			c.count(i, slot, int64(v))
+		}
+	}
+	if c.Kind == KindTimer {
+		c.addHour(t, 1)
+	} else {
+		c.addHour(t, v)
+	}
+	c.observe(t)
+}
+
+// slot returns the index of the slot of bucket i that t falls into.
+func (c *Counter) slot(i int, t time.Time) int {
+	return c.periods(i, t, c.Atime)
+}
+
+// AddItem counts an item submitted at time t to a top-K counter.
+func (c *Counter) AddItem(t time.Time, item string) {
+	c.initTopK()
+	c.initCounts()
+	for i, bucket := range Buckets {
+		slot := c.slot(i, t)
+		if slot < 0 || slot >= bucket.Size {
+			continue
+		}
+		c.count(i, slot, 1)
+		c.TopK[i][slot].Add(item)
+	}
+	c.addHour(t, 1)
+	c.observe(t)
+}
+
+// SlotTime returns the time the given slot of the bucket stands for.
+func (c *Counter) SlotTime(i, slot int) time.Time {
+	bucket := Buckets[i]
+	if bucket.Size == 1 {
+		return c.Atime
+	} else if c.loc != nil {
+		return calendarStart(i, c.Atime, slot, c.loc)
+	}
+	return c.align(c.Atime, bucket.Period).Add(-time.Duration(slot) * bucket.Period)
+}
+
+// SlotDuration returns the length of the given slot of the bucket, the time
+// from its start to the start of the next one.
+func (c *Counter) SlotDuration(i, slot int) time.Duration {
+	return c.SlotTime(i, slot-1).Sub(c.SlotTime(i, slot))
+}
+
+// Bytes encodes the counter. Counting kinds only keep their exact counts.
 func (c *Counter) Bytes() []byte {
+	c.initCounts()
+	enc := *c
+	if c.counting() {
+		enc.Values = nil
+	} else {
+		enc.Counts = nil
+	}
 	b := &bytes.Buffer{}
-	if err := gob.NewEncoder(b).Encode(c); err != nil {
+	if err := gob.NewEncoder(b).Encode(&enc); err != nil {
 		panic(err)
 	}
 	return b.Bytes()
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
-)
 
-const TestDBPath = "test.db"
+	"github.com/boltdb/bolt"
+)
 
 var seconds = 0
 
@@ -17,206 +21,214 @@ func init() {
 	}
 }
 
-func TestStoreIncr(t *testing.T) {
-	defer os.Remove(TestDBPath)
-	s, err := NewStore(TestDBPath)
+// tempDir creates a directory for the files of a test, which is removed when
+// the test ends.
+func tempDir(tb testing.TB) string {
+	dir, err := ioutil.TempDir("", "incr")
 	if err != nil {
-		t.Error(err)
+		tb.Fatal(err)
 	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
 
-	if err := s.Incr("foo", "bar"); err != nil {
-		t.Error(err)
-	}
+// tempPath returns the path of a file name in a new tempDir.
+func tempPath(tb testing.TB, name string) string {
+	return filepath.Join(tempDir(tb), name)
+}
+
+func TestStoreIncr(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if err := s.Incr("foo", "bar"); err != nil {
+			t.Error(err)
+		}
+	})
 }
 
 func TestStoreList(t *testing.T) {
-	defer os.Remove(TestDBPath)
-	s, _ := NewStore(TestDBPath)
-	s.Incr("foo", "bar")
-	s.Incr("foo", "baz")
-	s.Incr("foo", "qux")
-	if items, _ := s.List("foo"); len(items) != 3 {
-		t.Error(items)
-	} else if items[0] != "bar" || items[1] != "baz" || items[2] != "qux" {
-		t.Error(items)
-	}
-	if items, _ := s.List("badlist"); items == nil {
-		t.Error(items)
-	} else if len(items) != 0 {
-		t.Error(items)
-	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		s.Incr("foo", "bar")
+		s.Incr("foo", "baz")
+		s.Incr("foo", "qux")
+		if items, _ := s.List("foo"); len(items) != 3 {
+			t.Error(items)
+		} else if items[0].Name != "bar" || items[1].Name != "baz" || items[2].Name != "qux" {
+			t.Error(items)
+		}
+		if items, _ := s.List("badlist"); items == nil {
+			t.Error(items)
+		} else if len(items) != 0 {
+			t.Error(items)
+		}
+	})
 }
 
 func TestStoreQuery(t *testing.T) {
-	defer os.Remove(TestDBPath)
-	s, _ := NewStore(TestDBPath)
-	s.Incr("foo", "bar")
-	s.Incr("foo", "bar")
-	s.Incr("foo", "bar")
-	s.Incr("foo", "bar")
-	if c, err := s.Query("foo", "bar"); err != nil {
-		t.Error(err)
-	} else if c.Values[BucketIndex("total")][0] != 4 {
-		t.Error(c.Values[BucketIndex("total")])
-	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		s.Incr("foo", "bar")
+		s.Incr("foo", "bar")
+		s.Incr("foo", "bar")
+		s.Incr("foo", "bar")
+		if c, err := s.Query("foo", "bar"); err != nil {
+			t.Error(err)
+		} else if c.Values[BucketIndex("total")][0] != 4 {
+			t.Error(c.Values[BucketIndex("total")])
+		}
+	})
 }
 
 func TestStoreRolling(t *testing.T) {
-	defer os.Remove(TestDBPath)
-	s, _ := NewStore(TestDBPath)
-
-	seconds = 0
-	s.Incr("foo", "bar")
-
-	seconds = 5
-	s.Incr("foo", "bar")
-	s.Incr("foo", "bar")
-
-	c, _ := s.Query("foo", "bar")
-
-	if c.Values[BucketIndex("total")][0] != 3 {
-		t.Error(c.Values[BucketIndex("total")])
-	} else if c.Values[BucketIndex("realtime")][0] != 2 {
-		t.Error(c.Values[BucketIndex("realtime")])
-	} else if c.Values[BucketIndex("realtime")][1] != 0 {
-		t.Error(c.Values[BucketIndex("realtime")])
-	} else if c.Values[BucketIndex("realtime")][5] != 1 {
-		t.Error(c.Values[BucketIndex("realtime")])
-	}
-
-	seconds = 6
-	s.Incr("foo", "bar")
-
-	c, _ = s.Query("foo", "bar")
-	if c.Values[BucketIndex("total")][0] != 4 {
-		t.Error(c.Values[BucketIndex("total")])
-	} else if c.Values[BucketIndex("realtime")][0] != 1 {
-		t.Error(c.Values[BucketIndex("realtime")])
-	} else if c.Values[BucketIndex("realtime")][1] != 2 {
-		t.Error(c.Values[BucketIndex("realtime")])
-	} else if c.Values[BucketIndex("realtime")][5] != 0 {
-		t.Error(c.Values[BucketIndex("realtime")])
-	} else if c.Values[BucketIndex("realtime")][6] != 1 {
-		t.Error(c.Values[BucketIndex("realtime")])
-	}
-
-	seconds = 1000
-	s.Incr("foo", "bar")
-
-	c, _ = s.Query("foo", "bar")
-	if c.Values[BucketIndex("total")][0] != 5 {
-		t.Error(c.Values[BucketIndex("total")])
-	} else if c.Values[BucketIndex("realtime")][0] != 1 {
-		t.Error(c.Values[BucketIndex("realtime")])
-	} else if c.Values[BucketIndex("realtime")][1] != 0 {
-		t.Error(c.Values[BucketIndex("realtime")])
-	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		seconds = 0
+		s.Incr("foo", "bar")
+
+		seconds = 5
+		s.Incr("foo", "bar")
+		s.Incr("foo", "bar")
+
+		c, _ := s.Query("foo", "bar")
+
+		if c.Values[BucketIndex("total")][0] != 3 {
+			t.Error(c.Values[BucketIndex("total")])
+		} else if c.Values[BucketIndex("realtime")][0] != 2 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		} else if c.Values[BucketIndex("realtime")][1] != 0 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		} else if c.Values[BucketIndex("realtime")][5] != 1 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		}
+
+		seconds = 6
+		s.Incr("foo", "bar")
+
+		c, _ = s.Query("foo", "bar")
+		if c.Values[BucketIndex("total")][0] != 4 {
+			t.Error(c.Values[BucketIndex("total")])
+		} else if c.Values[BucketIndex("realtime")][0] != 1 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		} else if c.Values[BucketIndex("realtime")][1] != 2 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		} else if c.Values[BucketIndex("realtime")][5] != 0 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		} else if c.Values[BucketIndex("realtime")][6] != 1 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		}
+
+		seconds = 1000
+		s.Incr("foo", "bar")
+
+		c, _ = s.Query("foo", "bar")
+		if c.Values[BucketIndex("total")][0] != 5 {
+			t.Error(c.Values[BucketIndex("total")])
+		} else if c.Values[BucketIndex("realtime")][0] != 1 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		} else if c.Values[BucketIndex("realtime")][1] != 0 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		}
+	})
 }
 
 func TestStoreHourly(t *testing.T) {
-	defer os.Remove(TestDBPath)
-	s, _ := NewStore(TestDBPath)
-
-	seconds = 0
-	s.Incr("foo", "bar")
-	seconds = 5
-	s.Incr("foo", "bar")
-	seconds = 60
-	s.Incr("foo", "bar")
-	c, _ := s.Query("foo", "bar")
-	if c.Values[BucketIndex("day")][0] != 3 {
-		t.Error(c.Values[BucketIndex("day")])
-	}
-	seconds = 3600
-	s.Incr("foo", "bar")
-
-	c, _ = s.Query("foo", "bar")
-	if c.Values[BucketIndex("day")][0] != 1 {
-		t.Error(c.Values[BucketIndex("day")])
-	} else if c.Values[BucketIndex("day")][1] != 3 {
-		t.Error(c.Values[BucketIndex("day")])
-	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		seconds = 0
+		s.Incr("foo", "bar")
+		seconds = 5
+		s.Incr("foo", "bar")
+		seconds = 60
+		s.Incr("foo", "bar")
+		c, _ := s.Query("foo", "bar")
+		if c.Values[BucketIndex("day")][0] != 3 {
+			t.Error(c.Values[BucketIndex("day")])
+		}
+		seconds = 3600
+		s.Incr("foo", "bar")
+
+		c, _ = s.Query("foo", "bar")
+		if c.Values[BucketIndex("day")][0] != 1 {
+			t.Error(c.Values[BucketIndex("day")])
+		} else if c.Values[BucketIndex("day")][1] != 3 {
+			t.Error(c.Values[BucketIndex("day")])
+		}
+	})
 }
 
 func TestStoreDaily(t *testing.T) {
-	defer os.Remove(TestDBPath)
-	s, _ := NewStore(TestDBPath)
-
-	seconds = 0
-	s.Incr("foo", "bar")
-	seconds = 5
-	s.Incr("foo", "bar")
-	seconds = 60
-	s.Incr("foo", "bar")
-	c, _ := s.Query("foo", "bar")
-	if c.Values[BucketIndex("month")][0] != 3 {
-		t.Error(c.Values[BucketIndex("month")])
-	}
-	seconds = 3600
-	s.Incr("foo", "bar")
-
-	seconds = 24 * 3600
-	s.Incr("foo", "bar")
-
-	seconds = 48 * 3600
-	s.Incr("foo", "bar")
-	s.Incr("foo", "bar")
-
-	c, _ = s.Query("foo", "bar")
-	if c.Values[BucketIndex("month")][0] != 2 {
-		t.Error(c.Values[BucketIndex("month")])
-	} else if c.Values[BucketIndex("month")][1] != 1 {
-		t.Error(c.Values[BucketIndex("month")])
-	} else if c.Values[BucketIndex("month")][2] != 4 {
-		t.Error(c.Values[BucketIndex("month")])
-	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		seconds = 0
+		s.Incr("foo", "bar")
+		seconds = 5
+		s.Incr("foo", "bar")
+		seconds = 60
+		s.Incr("foo", "bar")
+		c, _ := s.Query("foo", "bar")
+		if c.Values[BucketIndex("month")][0] != 3 {
+			t.Error(c.Values[BucketIndex("month")])
+		}
+		seconds = 3600
+		s.Incr("foo", "bar")
+
+		seconds = 24 * 3600
+		s.Incr("foo", "bar")
+
+		seconds = 48 * 3600
+		s.Incr("foo", "bar")
+		s.Incr("foo", "bar")
+
+		c, _ = s.Query("foo", "bar")
+		if c.Values[BucketIndex("month")][0] != 2 {
+			t.Error(c.Values[BucketIndex("month")])
+		} else if c.Values[BucketIndex("month")][1] != 1 {
+			t.Error(c.Values[BucketIndex("month")])
+		} else if c.Values[BucketIndex("month")][2] != 4 {
+			t.Error(c.Values[BucketIndex("month")])
+		}
+	})
 }
 
 func TestStoreMonthly(t *testing.T) {
-	defer os.Remove(TestDBPath)
-	s, _ := NewStore(TestDBPath)
-
-	seconds = 0
-	s.Incr("foo", "bar")
-	seconds = 5
-	s.Incr("foo", "bar")
-	seconds = 60
-	s.Incr("foo", "bar")
-	c, _ := s.Query("foo", "bar")
-	if c.Values[BucketIndex("year")][0] != 3 {
-		t.Error(c.Values[BucketIndex("year")])
-	}
-	seconds = 24 * 3600
-	s.Incr("foo", "bar")
-	seconds = 48 * 3600
-	s.Incr("foo", "bar")
-
-	seconds = 40 * 24 * 3600
-	s.Incr("foo", "bar")
-	s.Incr("foo", "bar")
-
-	c, _ = s.Query("foo", "bar")
-	if c.Values[BucketIndex("year")][0] != 2 {
-		t.Error(c.Values[BucketIndex("year")])
-	} else if c.Values[BucketIndex("year")][1] != 5 {
-		t.Error(c.Values[BucketIndex("year")])
-	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		seconds = 0
+		s.Incr("foo", "bar")
+		seconds = 5
+		s.Incr("foo", "bar")
+		seconds = 60
+		s.Incr("foo", "bar")
+		c, _ := s.Query("foo", "bar")
+		if c.Values[BucketIndex("year")][0] != 3 {
+			t.Error(c.Values[BucketIndex("year")])
+		}
+		seconds = 24 * 3600
+		s.Incr("foo", "bar")
+		seconds = 48 * 3600
+		s.Incr("foo", "bar")
+
+		seconds = 40 * 24 * 3600
+		s.Incr("foo", "bar")
+		s.Incr("foo", "bar")
+
+		c, _ = s.Query("foo", "bar")
+		if c.Values[BucketIndex("year")][0] != 2 {
+			t.Error(c.Values[BucketIndex("year")])
+		} else if c.Values[BucketIndex("year")][1] != 5 {
+			t.Error(c.Values[BucketIndex("year")])
+		}
+	})
 }
 
 func BenchmarkStoreIncr(b *testing.B) {
-	defer os.Remove(TestDBPath)
-	s, _ := NewStore(TestDBPath)
+	dbPath := tempPath(b, "test.db")
+	s, _ := NewStore(dbPath)
 	for i := 0; i < b.N; i++ {
 		seconds = i
 		s.Incr("foo", fmt.Sprintf("bar%d", i))
 	}
-	fi, _ := os.Stat(TestDBPath)
+	fi, _ := os.Stat(dbPath)
 	b.Log(fi.Size(), b.N)
 }
 
 func BenchmarkStoreQuery(b *testing.B) {
-	defer os.Remove(TestDBPath)
-	s, _ := NewStore(TestDBPath)
+	dbPath := tempPath(b, "test.db")
+	s, _ := NewStore(dbPath)
 	s.Incr("foo", "bar")
 	for i := 0; i < b.N; i++ {
 		s.Query("foo", "bar")
@@ -224,8 +236,8 @@ func BenchmarkStoreQuery(b *testing.B) {
 }
 
 func BenchmarkStoreList(b *testing.B) {
-	defer os.Remove(TestDBPath)
-	s, _ := NewStore(TestDBPath)
+	dbPath := tempPath(b, "test.db")
+	s, _ := NewStore(dbPath)
 	for i := 0; i < 500; i++ {
 		s.Incr("bar", fmt.Sprintf("bar%d", i))
 	}
@@ -237,3 +249,198 @@ func BenchmarkStoreList(b *testing.B) {
 		s.List("foo")
 	}
 }
+
+func TestStoreApply(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		seconds = 10
+		if err := s.Apply("foo", []Event{
+			{Metric: "bar", Value: 2},
+			{Metric: "bar", Value: 3, Ts: 5},
+			{Metric: "temp", Type: KindGauge, Value: 20},
+			{Metric: "temp", Type: KindGauge, Value: 21},
+			{Metric: "signup", Value: 1, Labels: map[string]string{"src": "ads", "plan": "free"}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if c, _ := s.Query("foo", "bar"); c.Values[BucketIndex("total")][0] != 5 {
+			t.Error(c.Values[BucketIndex("total")])
+		} else if c.Values[BucketIndex("realtime")][0] != 2 || c.Values[BucketIndex("realtime")][5] != 3 {
+			t.Error(c.Values[BucketIndex("realtime")])
+		}
+		if c, _ := s.Query("foo", "temp"); c.Kind != KindGauge || c.Values[BucketIndex("total")][0] != 21 {
+			t.Error(c.Kind, c.Values[BucketIndex("total")])
+		}
+		if _, err := s.Query("foo", "signup{plan=free,src=ads}"); err != nil {
+			t.Error(err)
+		}
+
+		// Batch is applied atomically
+		err := s.Apply("foo", []Event{
+			{Metric: "bar", Value: 1},
+			{Metric: "temp", Value: 1},
+		})
+		if e, ok := err.(*ItemError); !ok || e.Index != 1 || e.Err != ErrKind {
+			t.Error(err)
+		}
+		if c, _ := s.Query("foo", "bar"); c.Values[BucketIndex("total")][0] != 5 {
+			t.Error(c.Values[BucketIndex("total")])
+		}
+		err = s.Apply("foo", []Event{{Metric: "bar", Value: 1, Ts: 100}})
+		if e, ok := err.(*ItemError); !ok || e.Err != ErrFuture {
+			t.Error(err)
+		}
+	})
+}
+
+func TestStoreWalk(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		s.Incr("foo", "bar")
+		s.Incr("foo", "baz")
+		s.Incr("foobar", "qux")
+		defer func(n int) { WalkBatch = n }(WalkBatch)
+		WalkBatch = 1
+		names := []string{}
+		s.Walk("foo", func(name string, c *Counter) error {
+			names = append(names, name)
+			// Writes don't wait for the walk to end
+			return s.Incr("foo", "bar")
+		})
+		if len(names) != 2 || names[0] != "bar" || names[1] != "baz" {
+			t.Error(names)
+		}
+	})
+}
+
+func TestStoreOverflow(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		total := BucketIndex("total")
+
+		// float32 stops incrementing at 2^24, int64 counts don't
+		seconds = 0
+		s.Apply("foo", []Event{{Metric: "bar", Value: 1 << 24}})
+		s.Incr("foo", "bar")
+		s.Apply("foo", []Event{{Metric: "bar", Value: 1 << 53}, {Metric: "bar", Value: 1}})
+		c, _ := s.Query("foo", "bar")
+		if n := c.Counts[total][0]; n != 1<<53+1<<24+2 {
+			t.Error(n)
+		}
+		if v := c.Values[total][0]; v < 1<<53+1<<24 {
+			t.Error(v)
+		}
+
+		// Gauges keep float64 values
+		s.Apply("foo", []Event{{Metric: "temp", Type: KindGauge, Value: 0.1}})
+		if c, _ := s.Query("foo", "temp"); c.Values[total][0] != 0.1 || c.Counts != nil {
+			t.Error(c.Values[total], c.Counts)
+		}
+
+		// Counters are integers
+		err := s.Apply("foo", []Event{{Metric: "bar", Value: 0.5}})
+		if e, ok := err.(*ItemError); !ok || e.Err != ErrValue {
+			t.Error(err)
+		}
+	})
+}
+
+func TestStoreMigrateFloat32(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	// Counters used to be stored with float32 values only
+	type legacyCounter struct {
+		Kind   Kind
+		Atime  time.Time
+		Values [][]float32
+	}
+	seconds = 0
+	legacy := legacyCounter{Kind: KindCounter, Atime: Now()}
+	for _, bucket := range Buckets {
+		legacy.Values = append(legacy.Values, make([]float32, bucket.Size))
+	}
+	legacy.Values[BucketIndex("total")][0] = 1 << 24
+	b := &bytes.Buffer{}
+	gob.NewEncoder(b).Encode(legacy)
+	db, _ := bolt.Open(dbPath, 0600, nil)
+	db.Update(func(tx *bolt.Tx) error {
+		bucket, _ := tx.CreateBucketIfNotExists(IncrBucket)
+		return bucket.Put([]byte("foo:bar"), b.Bytes())
+	})
+	db.Close()
+
+	s, err := NewStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Incr("foo", "bar")
+	if c, _ := s.Query("foo", "bar"); c.Counts[BucketIndex("total")][0] != 1<<24+1 {
+		t.Error(c.Counts[BucketIndex("total")])
+	}
+}
+
+func TestStoreMigrateLayout(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	// Records used to be kept in flat buckets by "ns:name"
+	seconds = 0
+	rule := &bytes.Buffer{}
+	gob.NewEncoder(rule).Encode(&Rule{ID: "7", NS: "foo", Expr: "bar > 1"})
+	db, _ := bolt.Open(dbPath, 0600, nil)
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists(IncrBucket)
+		b.Put([]byte("foo:bar"), NewCounter(nil).Bytes())
+		b.Put([]byte("foo:baz:qux"), NewCounter(nil).Bytes())
+		b.Put([]byte("quux:bar"), NewCounter(nil).Bytes())
+		b, _ = tx.CreateBucketIfNotExists(DerivedBucket)
+		b.Put([]byte("foo:double"), []byte("bar * 2"))
+		b, _ = tx.CreateBucketIfNotExists(AlertsBucket)
+		b.Put([]byte("foo:7"), rule.Bytes())
+		return nil
+	})
+	db.Close()
+
+	s, err := NewStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(*store).db.Close()
+	if list, _ := s.List("foo"); len(list) != 3 || list[0].Name != "bar" || list[1].Name != "baz:qux" || list[2].Name != "double" {
+		t.Error(list)
+	}
+	if list, _ := s.List("quux"); len(list) != 1 {
+		t.Error(list)
+	}
+	if rules, _ := s.Rules("foo"); len(rules) != 1 || rules[0].ID != "7" {
+		t.Error(rules)
+	}
+	s.(*store).db.View(func(tx KVTx) error {
+		if tx.Bucket(IncrBucket).Get([]byte("foo:bar")) != nil {
+			t.Error("flat record left")
+		}
+		return nil
+	})
+}
+
+// updateHook runs a function before the next transaction.
+type updateHook struct {
+	Backend
+	before func()
+}
+
+func (h *updateHook) Update(fn func(tx KVTx) error) error {
+	if before := h.before; before != nil {
+		h.before = nil
+		before()
+	}
+	return h.Backend.Update(fn)
+}
+
+func TestStoreExpireDeleted(t *testing.T) {
+	db, _ := OpenMem("")
+	s, _ := NewStoreOn(db)
+	seconds = 100
+	s.Incr("foo", "bar")
+	s.PutNamespace(&Namespace{Name: "foo", Retention: "1h"})
+	seconds = 100 + 7200
+	// The namespace is deleted between finding and deleting expired counters
+	s.(*store).db = &updateHook{db, func() { s.DeleteNamespace("foo") }}
+	if e, err := s.Expire("foo", false); err != nil || len(e.Metrics) != 0 {
+		t.Error(e, err)
+	}
+}
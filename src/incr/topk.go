@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sort"
+)
+
+// TopKSize is the number of items a top-K slot keeps.
+const TopKSize = 20
+
+type TopKItem struct {
+	Item  string `json:"item"`
+	Count uint64 `json:"count"`
+	// Err is how much Count may overestimate the real count
+	Err uint64 `json:"err,omitempty"`
+}
+
+// TopK finds the most frequent items with the space-saving algorithm: once
+// TopKSize items are tracked, a new item replaces the least frequent one and
+// inherits its count.
+type TopK struct {
+	Items []TopKItem
+}
+
+func (k *TopK) Add(item string) {
+	min := -1
+	for i := range k.Items {
+		if k.Items[i].Item == item {
+			k.Items[i].Count++
+			return
+		}
+		if min < 0 || k.Items[i].Count < k.Items[min].Count {
+			min = i
+		}
+	}
+	if len(k.Items) < TopKSize {
+		k.Items = append(k.Items, TopKItem{Item: item, Count: 1})
+	} else {
+		n := k.Items[min].Count
+		k.Items[min] = TopKItem{Item: item, Count: n + 1, Err: n}
+	}
+}
+
+// Merge adds counts of another summary and keeps the TopKSize most
+// frequent items.
+func (k *TopK) Merge(o TopK) {
+	for _, oi := range o.Items {
+		found := false
+		for i := range k.Items {
+			if k.Items[i].Item == oi.Item {
+				k.Items[i].Count += oi.Count
+				k.Items[i].Err += oi.Err
+				found = true
+				break
+			}
+		}
+		if !found {
+			k.Items = append(k.Items, oi)
+		}
+	}
+	if len(k.Items) > TopKSize {
+		k.Items = k.Top()[:TopKSize]
+	}
+}
+
+// Top returns the items, most frequent first.
+func (k *TopK) Top() []TopKItem {
+	top := append([]TopKItem{}, k.Items...)
+	sort.Sort(byCount(top))
+	return top
+}
+
+type byCount []TopKItem
+
+func (a byCount) Len() int      { return len(a) }
+func (a byCount) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byCount) Less(i, j int) bool {
+	if a[i].Count != a[j].Count {
+		return a[i].Count > a[j].Count
+	}
+	return a[i].Item < a[j].Item
+}
+
+// Top returns the ranked items of every slot of the bucket.
+func (c *Counter) Top(i int) [][]TopKItem {
+	top := make([][]TopKItem, Buckets[i].Size)
+	for slot := range top {
+		top[slot] = []TopKItem{}
+		if c.TopK != nil {
+			top[slot] = c.TopK[i][slot].Top()
+		}
+	}
+	return top
+}
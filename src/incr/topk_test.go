@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	k := TopK{}
+	for i := 0; i < 100; i++ {
+		k.Add("/home")
+		if i%2 == 0 {
+			k.Add("/about")
+		}
+		k.Add(fmt.Sprintf("/rare/%d", i))
+	}
+	top := k.Top()
+	if len(top) != TopKSize {
+		t.Fatal(top)
+	}
+	if top[0].Item != "/home" || top[0].Count != 100 || top[0].Err != 0 {
+		t.Error(top[0])
+	} else if top[1].Item != "/about" || top[1].Count != 50 {
+		t.Error(top[1])
+	}
+
+	o := TopK{}
+	for i := 0; i < 200; i++ {
+		o.Add("/pricing")
+	}
+	k.Merge(o)
+	if top := k.Top(); len(top) != TopKSize || top[0].Item != "/pricing" || top[1].Item != "/home" {
+		t.Error(top)
+	}
+}
+
+func TestStoreTopK(t *testing.T) {
+	dbPath := tempPath(t, "test.db")
+	s, _ := NewStore(dbPath)
+
+	events := []Event{}
+	if err := json.Unmarshal([]byte(`[
+		{"metric": "url", "type": "topk", "value": "/home"},
+		{"metric": "url", "type": "topk", "value": "/about", "ts": 2},
+		{"metric": "url", "type": "topk", "value": "/home", "ts": 2}
+	]`), &events); err != nil {
+		t.Fatal(err)
+	}
+	seconds = 2
+	if err := s.Apply("foo", events); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := s.Query("foo", "url")
+	if total := c.Top(BucketIndex("total"))[0]; len(total) != 2 || total[0] != (TopKItem{Item: "/home", Count: 2}) {
+		t.Error(total)
+	}
+	if c.Values[BucketIndex("total")][0] != 3 {
+		t.Error(c.Values[BucketIndex("total")])
+	}
+
+	seconds = 3
+	c, _ = s.Query("foo", "url")
+	if realtime := c.Top(BucketIndex("realtime")); len(realtime[0]) != 0 || len(realtime[1]) != 2 {
+		t.Error(realtime)
+	}
+
+	if err := s.Apply("foo", []Event{{Metric: "url", Type: KindTopK}}); err == nil {
+		t.Error("accepted top-K without item")
+	}
+	if err := s.Apply("foo", []Event{{Metric: "visits", Item: "/home"}}); err == nil {
+		t.Error("accepted counter with item")
+	}
+}
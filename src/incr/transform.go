@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transforms operate on the values of a single bucket, latest slot first,
+// and return a new slice of the same length.
+
+// Rate normalises the values of bucket i of the counter to per-second rates.
+// Slots are divided by their actual length, which varies for calendar days
+// and months. The total bucket has no period, so its rate is always zero.
+func Rate(c *Counter, i int, values []Value) []Value {
+	out := make([]Value, len(values))
+	if Buckets[i].Size == 1 {
+		return out
+	}
+	for slot, v := range values {
+		out[slot] = v / Value(c.SlotDuration(i, slot)/time.Second)
+	}
+	return out
+}
+
+// MovingAverage averages every slot with n-1 slots before it, fewer at the
+// oldest end of the bucket.
+func MovingAverage(values []Value, n int) []Value {
+	out := make([]Value, len(values))
+	for i := range values {
+		sum, count := Value(0), 0
+		for j := i; j < len(values) && j < i+n; j++ {
+			sum += values[j]
+			count++
+		}
+		out[i] = sum / Value(count)
+	}
+	return out
+}
+
+// CumSum sums every slot with all slots before it.
+func CumSum(values []Value) []Value {
+	out := make([]Value, len(values))
+	sum := Value(0)
+	for i := len(values) - 1; i >= 0; i-- {
+		sum += values[i]
+		out[i] = sum
+	}
+	return out
+}
+
+// Diff is the difference of every slot from the previous one, the oldest slot
+// has nothing to compare with and is zero.
+func Diff(values []Value) []Value {
+	out := make([]Value, len(values))
+	for i := 0; i < len(values)-1; i++ {
+		out[i] = values[i] - values[i+1]
+	}
+	return out
+}
+
+// PctChange is the change of every slot from the previous one in percent.
+// Change from zero is zero.
+func PctChange(values []Value) []Value {
+	out := make([]Value, len(values))
+	for i := 0; i < len(values)-1; i++ {
+		if values[i+1] != 0 {
+			out[i] = (values[i] - values[i+1]) / values[i+1] * 100
+		}
+	}
+	return out
+}
+
+// Transform is a named transform taking Args positive numeric arguments. Fn
+// gets the values of bucket i and a counter telling the times of its slots.
+type Transform struct {
+	Args int
+	Fn   func(c *Counter, i int, values []Value, args []Value) []Value
+}
+
+var Transforms = map[string]Transform{
+	"rate":   {0, func(c *Counter, i int, v []Value, _ []Value) []Value { return Rate(c, i, v) }},
+	"ma":     {1, func(_ *Counter, _ int, v []Value, args []Value) []Value { return MovingAverage(v, int(args[0])) }},
+	"cumsum": {0, func(_ *Counter, _ int, v []Value, _ []Value) []Value { return CumSum(v) }},
+	"diff":   {0, func(_ *Counter, _ int, v []Value, _ []Value) []Value { return Diff(v) }},
+	"pct":    {0, func(_ *Counter, _ int, v []Value, _ []Value) []Value { return PctChange(v) }},
+}
+
+// ParseTransforms parses a comma separated list of transforms with arguments
+// after colons, e.g. "rate,ma:5", and returns a function applying them in
+// order to every bucket of a counter.
+func ParseTransforms(s string) (func(c *Counter), error) {
+	type step struct {
+		t    Transform
+		args []Value
+	}
+	steps := []step{}
+	for _, item := range strings.Split(s, ",") {
+		f := strings.Split(item, ":")
+		t, ok := Transforms[f[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", f[0])
+		}
+		if len(f)-1 != t.Args {
+			return nil, fmt.Errorf("%s takes %d arguments", f[0], t.Args)
+		}
+		args := []Value{}
+		for _, arg := range f[1:] {
+			v, err := strconv.ParseFloat(arg, 64)
+			if err != nil || v < 1 {
+				return nil, fmt.Errorf("%s argument must be a positive number", f[0])
+			}
+			args = append(args, Value(v))
+		}
+		steps = append(steps, step{t, args})
+	}
+	return func(c *Counter) {
+		for _, st := range steps {
+			for i := range Buckets {
+				c.Values[i] = st.t.Fn(c, i, c.Values[i], st.args)
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransforms(t *testing.T) {
+	values := []Value{4, 2, 0, 2}
+	eq := func(a, b []Value) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return len(a) == len(b)
+	}
+	if v := CumSum(values); !eq(v, []Value{8, 4, 2, 2}) {
+		t.Error(v)
+	}
+	if v := Diff(values); !eq(v, []Value{2, 2, -2, 0}) {
+		t.Error(v)
+	}
+	if v := PctChange(values); !eq(v, []Value{100, 0, -100, 0}) {
+		t.Error(v)
+	}
+	if v := MovingAverage(values, 2); !eq(v, []Value{3, 1, 1, 2}) {
+		t.Error(v)
+	}
+	c := NewCounter(nil)
+	if v := Rate(c, BucketIndex("realtime"), values); !eq(v, values) {
+		t.Error(v)
+	}
+	if v := Rate(c, BucketIndex("total"), []Value{5}); v[0] != 0 {
+		t.Error(v)
+	}
+}
+
+func TestRateCalendar(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	setNow(time.Date(2016, 3, 29, 12, 0, 0, 0, berlin))
+	c := NewCounterIn(nil, berlin)
+	month, year := BucketIndex("month"), BucketIndex("year")
+	// March 27th had 23 hours, March 743 hours and February 29 days
+	values := []Value{86400, 86400, 82800}
+	if v := Rate(c, month, values); v[0] != 1 || v[1] != 1 || v[2] != 1 {
+		t.Error(v)
+	}
+	if v := Rate(c, year, []Value{743 * 3600, 29 * 86400}); v[0] != 1 || v[1] != 1 {
+		t.Error(v)
+	}
+	// Without a time zone periods are fixed
+	if v := Rate(NewCounter(nil), month, values); v[0] != 1 || v[2] == 1 {
+		t.Error(v)
+	}
+}
+
+func TestParseTransforms(t *testing.T) {
+	c := NewCounter(nil)
+	day := BucketIndex("day")
+	c.Values[day][0], c.Values[day][1] = 7200, 3600
+	fn, err := ParseTransforms("rate,ma:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(c)
+	if c.Values[day][0] != 1.5 || c.Values[day][1] != 0.5 {
+		t.Error(c.Values[day])
+	}
+	for _, s := range []string{"", "foo", "ma", "ma:0", "rate:1", "ma:x"} {
+		if _, err := ParseTransforms(s); err == nil {
+			t.Error(s)
+		}
+	}
+}
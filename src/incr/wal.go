@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// WALCheckpointInterval and WALCheckpointSize tell how often the backend is
+// synced and the log truncated, whichever comes first.
+var WALCheckpointInterval = time.Minute
+var WALCheckpointSize int64 = 64 << 20
+
+var ErrClosed = errors.New("store is closed")
+var ErrCorrupt = errors.New("corrupt record")
+var ErrRecordSize = errors.New("record too large")
+
+// WALBucket keeps the sequence number of the last record of the log applied
+// to the backend. Records at or below it are skipped on replay: with
+// deferred fsync most of them usually survive a crash of the process.
+//
+// It also keeps the epoch of the database, which Restore changes. Records
+// of another epoch were logged before a restore and are not replayed: they
+// belong to the replaced database, not the restored snapshot.
+var WALBucket = []byte("wal")
+var walSeqKey = []byte("seq")
+var walEpochKey = []byte("epoch")
+
+// deferredSync is implemented by backends that can leave fsync of committed
+// transactions to a later Sync, the write-ahead log keeps them durable in the
+// meantime.
+type deferredSync interface {
+	DeferSync()
+	Sync() error
+}
+
+// walStore appends events to a write-ahead log before they are applied.
+// Concurrent writes are fsync'd and applied in groups, one fsync and one
+// transaction for all writes that arrived while the previous group was being
+// written, while each write still returns only once it is durable.
+type walStore struct {
+	*store
+	f            *os.File
+	size         int64
+	checkpointed time.Time
+	syncs        int
+	// seq is the sequence number of the last logged record
+	seq   uint64
+	epoch uint64
+
+	mu      sync.Mutex
+	pending []*walWrite
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// walWrite is a record of the log, a batch of events of one namespace.
+type walWrite struct {
+	Seq    uint64
+	Epoch  uint64
+	NS     string
+	Events []Event
+
+	err  error
+	done chan struct{}
+}
+
+// NewWALStore opens the store on db with a write-ahead log at path. Writes
+// left in the log by a crash are applied first.
+func NewWALStore(path string, db Backend) (Store, error) {
+	if d, ok := db.(deferredSync); ok {
+		d.DeferSync()
+	}
+	s, err := NewStoreOn(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx KVTx) error {
+		_, err := tx.CreateBucketIfNotExists(WALBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	w := &walStore{store: s.(*store), f: f, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	if err := w.replay(); err != nil {
+		f.Close()
+		db.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Incr is logged as a counter event, so that replay adds it to the slot of
+// the time it happened.
+func (w *walStore) Incr(ns, name string) error {
+	return w.Apply(ns, []Event{{Metric: name, Value: 1}})
+}
+
+func (w *walStore) Apply(ns string, events []Event) error {
+	now := Now().Unix()
+	logged := make([]Event, len(events))
+	for i, e := range events {
+		if err := e.Validate(); err != nil {
+			return &ItemError{i, err}
+		}
+		if e.Ts == 0 {
+			e.Ts = now
+		}
+		logged[i] = e
+	}
+	write := &walWrite{NS: ns, Events: logged, done: make(chan struct{})}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.pending = append(w.pending, write)
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	w.mu.Unlock()
+	<-write.done
+	return write.err
+}
+
+// Other writes are rare and not logged, they are synced right away.
+func (w *walStore) Import(ns string, counters map[string]*Counter) error {
+	return w.synced(w.store.Import(ns, counters))
+}
+func (w *walStore) PutRule(r *Rule) error {
+	return w.synced(w.store.PutRule(r))
+}
+func (w *walStore) PutRuleState(r *Rule) error {
+	return w.synced(w.store.PutRuleState(r))
+}
+func (w *walStore) DeleteRule(ns, id string) error {
+	return w.synced(w.store.DeleteRule(ns, id))
+}
+func (w *walStore) PutDerived(ns, name, expr string) error {
+	return w.synced(w.store.PutDerived(ns, name, expr))
+}
+func (w *walStore) DeleteDerived(ns, name string) error {
+	return w.synced(w.store.DeleteDerived(ns, name))
+}
+func (w *walStore) PutMeta(ns, name string, meta *MetricMeta) error {
+	return w.synced(w.store.PutMeta(ns, name, meta))
+}
+func (w *walStore) CreateNamespace(n *Namespace) error {
+	return w.synced(w.store.CreateNamespace(n))
+}
+func (w *walStore) PutNamespace(n *Namespace) error {
+	return w.synced(w.store.PutNamespace(n))
+}
+func (w *walStore) DeleteNamespace(ns string) error {
+	return w.synced(w.store.DeleteNamespace(ns))
+}
+func (w *walStore) Expire(ns string, dryRun bool) (*Expiry, error) {
+	expiry, err := w.store.Expire(ns, dryRun)
+	return expiry, w.synced(err)
+}
+
+func (w *walStore) synced(err error) error {
+	if d, ok := w.db.(deferredSync); ok && err == nil {
+		return d.Sync()
+	}
+	return err
+}
+
+// Close applies pending writes, checkpoints and closes the log and the
+// backend.
+func (w *walStore) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.wake)
+	}
+	w.mu.Unlock()
+	<-w.done
+	err := w.checkpoint()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := w.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *walStore) run() {
+	defer close(w.done)
+	// Writes that don't go through the log, e.g. replicated ones on a
+	// follower, are synced by the periodic checkpoint
+	ticker := time.NewTicker(WALCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case _, ok := <-w.wake:
+			if !ok {
+				return
+			}
+			w.commitPending()
+		case <-ticker.C:
+			if err := w.checkpoint(); err != nil {
+				log.Println("wal checkpoint:", err)
+			}
+		}
+	}
+}
+
+func (w *walStore) commitPending() {
+	w.mu.Lock()
+	group := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+	if len(group) == 0 {
+		return
+	}
+	err := w.commit(group)
+	for _, write := range group {
+		if write.err == nil {
+			write.err = err
+		}
+		close(write.done)
+	}
+	if err == nil && (w.size >= WALCheckpointSize || time.Since(w.checkpointed) >= WALCheckpointInterval) {
+		if err := w.checkpoint(); err != nil {
+			log.Println("wal checkpoint:", err)
+		}
+	}
+}
+
+// commit logs the group with one fsync and applies it in one transaction. If
+// either fails the log is cut back, so that failed writes are not replayed.
+func (w *walStore) commit(group []*walWrite) error {
+	buf := &bytes.Buffer{}
+	for i, write := range group {
+		write.Seq, write.Epoch = w.seq+uint64(i)+1, w.epoch
+		if err := writeRecord(buf, write); err != nil {
+			return err
+		}
+	}
+	if _, err := w.f.WriteAt(buf.Bytes(), w.size); err != nil {
+		w.f.Truncate(w.size)
+		return err
+	} else if err := w.f.Sync(); err != nil {
+		w.f.Truncate(w.size)
+		return err
+	}
+	w.syncs++
+	if err := w.applyAll(group); err != nil {
+		w.f.Truncate(w.size)
+		return err
+	}
+	w.size += int64(buf.Len())
+	w.seq += uint64(len(group))
+	return nil
+}
+
+// checkpoint makes applied writes durable in the backend and empties the
+// log.
+func (w *walStore) checkpoint() error {
+	if d, ok := w.db.(deferredSync); ok {
+		if err := d.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	} else if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.size = 0
+	w.checkpointed = time.Now()
+	return nil
+}
+
+// replay applies all complete records of the log that the backend doesn't
+// have yet. A torn record at the end, left by a crash in the middle of a
+// write, was never acknowledged and is dropped.
+func (w *walStore) replay() error {
+	data, err := ioutil.ReadAll(w.f)
+	if err != nil {
+		return err
+	}
+	if err := w.db.View(func(tx KVTx) error {
+		if v := tx.Bucket(WALBucket).Get(walSeqKey); v != nil {
+			w.seq = binary.BigEndian.Uint64(v)
+		}
+		if v := tx.Bucket(WALBucket).Get(walEpochKey); v != nil {
+			w.epoch = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	applied := w.seq
+	n, stale, group := 0, 0, []*walWrite{}
+	r := bytes.NewReader(data)
+	for {
+		write := &walWrite{}
+		if err := readRecord(r, write); err != nil {
+			break
+		}
+		if write.Epoch != w.epoch {
+			stale++
+			continue
+		}
+		if write.Seq > w.seq {
+			w.seq = write.Seq
+		}
+		if write.Seq <= applied {
+			continue
+		}
+		group = append(group, write)
+		if len(group) == 1000 {
+			if err := w.applyAll(group); err != nil {
+				return err
+			}
+			n, group = n+len(group), group[:0]
+		}
+	}
+	if err := w.applyAll(group); err != nil {
+		return err
+	}
+	if n += len(group); n > 0 {
+		log.Printf("replayed %d writes from the log", n)
+	}
+	if stale > 0 {
+		log.Printf("dropped %d writes logged before the database was restored", stale)
+	}
+	return w.checkpoint()
+}
+
+// applyAll applies the writes in one transaction together with the sequence
+// number of the last one. A write that fails, e.g. because of a kind
+// mismatch, gets its own error and doesn't affect others.
+func (s *store) applyAll(writes []*walWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx KVTx) error {
+		seq := make([]byte, 8)
+		binary.BigEndian.PutUint64(seq, writes[len(writes)-1].Seq)
+		if err := tx.Bucket(WALBucket).Put(walSeqKey, seq); err != nil {
+			return err
+		}
+		for _, write := range writes {
+			var counters map[string]*Counter
+			b, err := createNSBucket(tx, IncrBucket, write.NS)
+			if err == nil {
+				counters, err = apply(b.Get, getter(nsBucket(tx, DerivedBucket, write.NS)), write.Events, location(tx, write.NS))
+			}
+			if write.err = err; err != nil {
+				continue
+			}
+			for name, cnt := range counters {
+				if err := b.Put([]byte(name), cnt.Bytes()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Records are framed by their length and CRC-32 so that a torn write is
+// detected on replay.
+func writeRecord(w io.Writer, v interface{}) error {
+	payload := &bytes.Buffer{}
+	if err := gob.NewEncoder(payload).Encode(v); err != nil {
+		return err
+	}
+	if payload.Len() > math.MaxUint32 {
+		return ErrRecordSize
+	}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(payload.Len()))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload.Bytes())
+	return err
+}
+
+// readRecord decodes the next record into v. A record cut short by the end of
+// r is io.ErrUnexpectedEOF, one with a wrong checksum ErrCorrupt.
+func readRecord(r io.Reader, v interface{}) error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	// The length may be garbage, so the payload grows as it is read
+	payload := &bytes.Buffer{}
+	if _, err := io.CopyN(payload, r, int64(binary.BigEndian.Uint32(header))); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	} else if crc32.ChecksumIEEE(payload.Bytes()) != binary.BigEndian.Uint32(header[4:]) {
+		return ErrCorrupt
+	}
+	return gob.NewDecoder(payload).Decode(v)
+}
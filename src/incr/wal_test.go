@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newWALStore(t *testing.T, path string) *walStore {
+	db, _ := OpenMem("")
+	s, err := NewWALStore(path, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*walStore)
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	walPath := tempPath(t, "test.wal")
+	s := newWALStore(t, walPath)
+	defer s.Close()
+
+	n := 200
+	wg := sync.WaitGroup{}
+	// Hold the backend, so that writes queue up behind the first commit
+	// however goroutines are scheduled
+	held, release := make(chan struct{}), make(chan struct{})
+	go s.db.Update(func(tx KVTx) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Apply("foo", []Event{{Metric: "bar", Value: 1}}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for queued := 0; queued < n-1; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		queued = len(s.pending)
+		s.mu.Unlock()
+	}
+	close(release)
+	wg.Wait()
+	if s.syncs >= n {
+		t.Error("writes were not grouped", s.syncs)
+	}
+	if v := total(s, "foo", "bar"); v != Value(n) {
+		t.Error(v)
+	}
+	// Writes fail separately
+	if err := s.Apply("foo", []Event{{Metric: "bar", Type: KindGauge, Value: 1}}); err == nil {
+		t.Error("kind mismatch")
+	}
+	if err := s.Incr("foo", "bar"); err != nil {
+		t.Error(err)
+	}
+	if v := total(s, "foo", "bar"); v != Value(n+1) {
+		t.Error(v)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	walPath := tempPath(t, "test.wal")
+	s := newWALStore(t, walPath)
+	if err := s.Apply("foo", []Event{{Metric: "bar", Value: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Incr("foo", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	// Crash in the middle of the next write, the unsynced backend is lost
+	s.mu.Lock()
+	s.closed = true
+	close(s.wake)
+	s.mu.Unlock()
+	<-s.done
+	s.f.Close()
+	f, _ := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	r := newWALStore(t, walPath)
+	defer r.Close()
+	if v := total(r, "foo", "bar"); v != 3 {
+		t.Error(v)
+	}
+	if v := total(r, "foo", "baz"); v != 1 {
+		t.Error(v)
+	}
+	if fi, _ := os.Stat(walPath); fi.Size() != 0 {
+		t.Error("log was not truncated", fi.Size())
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	walPath := tempPath(t, "test.wal")
+	defer func(size int64) { WALCheckpointSize = size }(WALCheckpointSize)
+	WALCheckpointSize = 1
+	s := newWALStore(t, walPath)
+	defer s.Close()
+	if err := s.Incr("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	// Writes are acknowledged before the checkpoint
+	eventually(t, func() bool {
+		fi, _ := os.Stat(walPath)
+		return fi.Size() == 0
+	})
+}
+
+// crash stops the store without a checkpoint, like a killed process whose
+// unsynced writes are still in the page cache.
+func crash(s *walStore) {
+	s.mu.Lock()
+	s.closed = true
+	close(s.wake)
+	s.mu.Unlock()
+	<-s.done
+	s.f.Close()
+	s.db.Close()
+}
+
+func TestWALReplayApplied(t *testing.T) {
+	path := tempPath(t, "test-wal.db")
+	walPath := tempPath(t, "test.wal")
+	open := func() *walStore {
+		db, err := OpenBolt(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewWALStore(walPath, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.(*walStore)
+	}
+	s := open()
+	s.Apply("foo", []Event{{Metric: "bar", Value: 3}})
+	s.Incr("gone", "baz")
+	if err := s.DeleteNamespace("gone"); err != nil {
+		t.Fatal(err)
+	}
+	crash(s)
+
+	s = open()
+	if v := total(s, "foo", "bar"); v != 3 {
+		t.Error(v)
+	}
+	if list, _ := s.Namespaces(); len(list) != 1 || list[0].Name != "foo" {
+		t.Error(list)
+	}
+	// Sequence numbers go on after the replay
+	s.Incr("foo", "bar")
+	crash(s)
+
+	s = open()
+	defer s.Close()
+	if v := total(s, "foo", "bar"); v != 4 {
+		t.Error(v)
+	}
+}
+
+func TestWALRestore(t *testing.T) {
+	path := tempPath(t, "test-wal.db")
+	walPath := tempPath(t, "test.wal")
+	open := func() *walStore {
+		db, err := OpenBolt(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewWALStore(walPath, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.(*walStore)
+	}
+	s := open()
+	s.Incr("foo", "bar")
+	snapshot := &bytes.Buffer{}
+	if _, err := s.Backup(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	// Writes after the snapshot are left in the log
+	s.Incr("foo", "bar")
+	crash(s)
+
+	if err := Restore(path, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	s = open()
+	if v := total(s, "foo", "bar"); v != 1 {
+		t.Error(v)
+	}
+	// New writes are replayed into the restored database
+	s.Incr("foo", "bar")
+	crash(s)
+	s = open()
+	defer s.Close()
+	if v := total(s, "foo", "bar"); v != 2 {
+		t.Error(v)
+	}
+}
@@ -62,7 +62,9 @@ export default class IncrCard extends React.Component {
 		var hits = [
 			<td key='sparkline' style={{textAlign: 'left'}}>
 				<Sparklines data={data.hits} width={200}>
-					<SparklinesLine color={MaterialColors.cyan500} />
+					{this.props.chart == 'bar' ?
+						<SparklinesBars style={{fill: MaterialColors.cyan500}} /> :
+						<SparklinesLine color={MaterialColors.cyan500} />}
 					<SparklinesReferenceLine type="mean" />
 				</Sparklines>
 			</td>
@@ -119,7 +121,7 @@ export default class IncrCard extends React.Component {
 			data = <CircularProgress />
 			total = '...';
 		} else {
-			var total = "Total: " + this.state.data.total[0];
+			var total = "Total: " + this.state.data.total[0] + (this.props.unit ? ' ' + this.props.unit : '');
 			data = this.renderTable();
 		}
 		return <Card style={{marginBottom: '1em'}}>
@@ -32,8 +32,10 @@ export default class IncrCards extends React.Component {
 		if (this.state.counters.length == 0) {
 			return <div>No data in this namespace</div>
 		}
-		var cards =
-			this.state.counters.map((c) => <IncrCard key={c} id={c} ns={this.props.ns} name={c} />);
+		var cards = this.state.counters
+			.filter((c) => !c.hidden)
+			.map((c) => <IncrCard key={c.name} id={c.name} ns={this.props.ns}
+				name={c.description || c.name} unit={c.unit} chart={c.chart} />);
 		return <div>
 			{cards}
 		</div>